@@ -0,0 +1,576 @@
+/*
+ * docker-fw v0.2.4 - a complementary tool for Docker to manage custom
+ *                    firewall rules between/towards Docker containers
+ * Copyright (C) 2014~2016 gdm85 - https://github.com/gdm85/docker-fw/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const ALLOW_ORIGIN = "allow"
+
+// options of the 'allow' action
+type AllowOptions struct {
+	Expires *time.Time // optional
+	IpSet   bool       // store addresses in an ipset, with a single rule per port
+	Ports   []string   // optional, subset of the published host ports in 'port/protocol' form
+}
+
+// an external address whitelisted through 'allow' action
+type AllowedAddress struct {
+	Address string
+	Expires *time.Time `json:",omitempty"` // optional
+	Ports   []string   `json:",omitempty"` // optional, all published ports when empty
+	Label   string     `json:",omitempty"` // optional, container label that declared the address
+}
+
+// true if the published host port is part of the ports allowed for this address
+func (a *AllowedAddress) AllowsPort(port docker.APIPort) bool {
+	if len(a.Ports) == 0 {
+		return true
+	}
+	return inArray(a.Ports, fmt.Sprintf("%d/%s", port.PublicPort, port.Type))
+}
+
+// whitelist of external addresses recorded by 'allow' action
+// rules are generated from it for each of the ports currently published by the container;
+// when an ipset is used, addresses are its members and a single rule per port matches it
+type AllowList struct {
+	IpSet     string // optional
+	Addresses []*AllowedAddress
+}
+
+func (l *AllowList) Find(address string) *AllowedAddress {
+	for _, a := range l.Addresses {
+		if a.Address == address {
+			return a
+		}
+	}
+	return nil
+}
+
+// addresses that have not yet expired
+func (l *AllowList) ActiveAddresses() []*AllowedAddress {
+	now := time.Now()
+	active := []*AllowedAddress{}
+	for _, a := range l.Addresses {
+		if a.Expires == nil || a.Expires.After(now) {
+			active = append(active, a)
+		}
+	}
+	return active
+}
+
+// format in docker-fw style, one line per address
+func (l *AllowList) FormatAsFwCommands(target string) []string {
+	action := "allow"
+	if l.IpSet != "" {
+		action += " --ipset"
+	}
+
+	lines := []string{}
+	for _, a := range l.Addresses {
+		s := action
+		if len(a.Ports) != 0 {
+			s += " --ports=" + strings.Join(a.Ports, ",")
+		}
+		s = fmt.Sprintf("%s %s %s", s, target, a.Address)
+		if a.Expires != nil {
+			s += " " + formatExpiry(*a.Expires)
+		}
+		if a.Label != "" {
+			// declared in a label, thus commented out
+			s = fmt.Sprintf("# %s: %s", a.Label, s)
+		} else if a.Expires != nil && !a.Expires.After(time.Now()) {
+			// not yet removed by 'expire', thus commented out
+			s = "# expired: " + s
+		}
+		lines = append(lines, s)
+	}
+	return lines
+}
+
+// find the allow list of the collection, creating it if missing
+func (c *IptablesRulesCollection) FindAllowList(useIpSet bool) *AllowList {
+	for _, l := range c.AllowLists {
+		if (l.IpSet != "") == useIpSet {
+			return l
+		}
+	}
+
+	l := &AllowList{Addresses: []*AllowedAddress{}}
+	if useIpSet {
+		// ipset names can be at most 31 characters
+		l.IpSet = IPSET_PREFIX + c.cid[:12]
+	}
+	c.AllowLists = append(c.AllowLists, l)
+	return l
+}
+
+// corresponding to a subcommand
+// function to allow incoming traffic for a specific container
+// the whitelist is recorded, so that rules follow changes of the published ports
+func AllowExternal(cid string, whitelist4 []string, opts *AllowOptions) error {
+	container, err := ccl.LookupOnlineContainer(cid)
+	if err != nil {
+		return err
+	}
+
+	c, err := LoadRules(container)
+	if err != nil {
+		return err
+	}
+
+	if opts.IpSet && len(opts.Ports) != 0 {
+		// all members of the set are matched by the same rules
+		return errors.New("a subset of ports cannot be specified for ipset-backed allow lists")
+	}
+
+	l := c.FindAllowList(opts.IpSet)
+	for _, entry := range whitelist4 {
+		entry, err = normalizeAllowedAddress(entry)
+		if err != nil {
+			return err
+		}
+
+		if isMultiAddressAlias(entry) {
+			// groups and hostnames are stored as such, but must be valid right now
+			_, _, err := parseExternalAddress(entry)
+			if err != nil {
+				return err
+			}
+		}
+
+		a := l.Find(entry)
+		if a == nil {
+			a = &AllowedAddress{Address: entry}
+			l.Addresses = append(l.Addresses, a)
+		}
+		a.Expires = opts.Expires
+		a.Ports = opts.Ports
+	}
+
+	// set members are updated in place
+	if l.IpSet != "" {
+		_, err := l.SyncIpSet(false)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.applyAllowRules(container)
+	if err != nil {
+		return err
+	}
+
+	return c.Save()
+}
+
+// parse an address specified for 'allow' action; it can be an IPv4 address, a subnet or
+// a multi-address alias ('@group', 'dns:hostname'), in which case the alias is returned too
+func parseExternalAddress(entry string) ([]string, string, error) {
+	entry = strings.Trim(entry, " ")
+
+	if isMultiAddressAlias(entry) {
+		return ccl.ParseAddresses(entry, nil, false)
+	}
+
+	if !matchIpv4.MatchString(entry) {
+		return nil, "", errors.New("not a valid IPv4 address or subnet: " + entry)
+	}
+
+	// always make IPv4 specific, unless a subnet is specified
+	if !strings.Contains(entry, "/") {
+		entry += "/32"
+	}
+
+	return []string{entry}, "", nil
+}
+
+// parse a comma-separated list of host ports for 'allow' action, e.g. '443,53/udp'
+// protocol is 'tcp' when not specified
+func parseAllowedPorts(list string) ([]string, error) {
+	ports := []string{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.Trim(entry, " ")
+		parts := strings.SplitN(entry, "/", 2)
+		if len(parts) == 1 {
+			parts = append(parts, "tcp")
+		}
+
+		port, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil || port == 0 {
+			return nil, errors.New("not a valid port: " + entry)
+		}
+		if parts[1] != "tcp" && parts[1] != "udp" {
+			return nil, errors.New(fmt.Sprintf("not a valid protocol '%s' for port %d", parts[1], port))
+		}
+
+		spec := fmt.Sprintf("%d/%s", port, parts[1])
+		if !inArray(ports, spec) {
+			ports = append(ports, spec)
+		}
+	}
+	return ports, nil
+}
+
+// true if the binding is not restricted to a specific host address
+func isWildcardHostIp(ip string) bool {
+	return ip == "" || ip == "0.0.0.0"
+}
+
+// all ports published by container on IPv4 host addresses, validated to be usable by 'allow' action
+func publishedPorts(container *docker.Container) ([]docker.APIPort, error) {
+	ports := []docker.APIPort{}
+	for _, port := range container.NetworkSettings.PortMappingAPI() {
+		// skip this port, it has not been published
+		if port.PrivatePort == 0 {
+			continue
+		}
+
+		if port.Type != "tcp" && port.Type != "udp" {
+			return nil, errors.New(fmt.Sprintf("Unrecognized protocol '%s' for port %d of container %s", port.Type, port.PrivatePort, container.Name[1:]))
+		}
+		// IPv6 bindings are not managed
+		if strings.Contains(port.IP, ":") {
+			continue
+		}
+		if !isWildcardHostIp(port.IP) && net.ParseIP(port.IP) == nil {
+			return nil, errors.New(fmt.Sprintf("Unrecognized host ip '%s' for binding of port %d (container %s)", port.IP, port.PrivatePort, container.Name[1:]))
+		}
+
+		ports = append(ports, port)
+	}
+
+	return ports, nil
+}
+
+// filter of a rule generated by 'allow' action for the specified binding
+// when the port is published on a specific host address, the original destination must match it
+func allowFilter(port docker.APIPort) string {
+	filter := "! -i docker0 -o docker0"
+	if !isWildcardHostIp(port.IP) {
+		filter += " -m conntrack --ctorigdst " + port.IP + "/32"
+	}
+	return filter
+}
+
+// generate the rules of all allow lists for the ports currently published by container
+func (c *IptablesRulesCollection) allowRules(container *docker.Container) ([]*ActiveIptablesRule, error) {
+	if len(c.AllowLists) == 0 {
+		return nil, nil
+	}
+
+	ports, err := publishedPorts(container)
+	if err != nil {
+		return nil, err
+	}
+
+	containerIpv4 := container.NetworkSettings.IPAddress + "/32"
+
+	rules := []*ActiveIptablesRule{}
+	for _, l := range c.AllowLists {
+		// resolve all addresses once for all ports
+		sources := []*IptablesRule{}
+		expiries := []*time.Time{}
+		allowed := []*AllowedAddress{}
+		if l.IpSet != "" {
+			if len(l.ActiveAddresses()) == 0 {
+				// an empty set matches nothing, its rules are deleted
+				continue
+			}
+			sources = append(sources, &IptablesRule{SourceSet: l.IpSet})
+			expiries = append(expiries, nil)
+			allowed = append(allowed, &AllowedAddress{})
+		} else {
+			for _, a := range l.ActiveAddresses() {
+				addresses, alias, err := parseExternalAddress(a.Address)
+				if err != nil && isMultiAddressAlias(a.Address) {
+					// e.g. DNS failure, keep the last resolved rules
+					log.Printf("WARNING: cannot resolve '%s' for container '%s', keeping its last resolved rules: %s", a.Address, container.Name[1:], err)
+					for _, r := range c.Rules {
+						if r.Origin == ALLOW_ORIGIN && r.SourceAlias == a.Address {
+							rules = append(rules, r)
+						}
+					}
+					continue
+				}
+				if err != nil {
+					return nil, err
+				}
+				for _, address := range addresses {
+					sources = append(sources, &IptablesRule{Source: address, SourceAlias: alias})
+					expiries = append(expiries, a.Expires)
+					allowed = append(allowed, a)
+				}
+			}
+		}
+
+		for _, port := range ports {
+			for i, source := range sources {
+				if !allowed[i].AllowsPort(port) {
+					continue
+				}
+
+				rule := ActiveIptablesRule{Chain: "FORWARD", JumpTo: DOCKER_CHAIN, Origin: ALLOW_ORIGIN, Expires: expiries[i]}
+				rule.IptablesRule = IptablesRule{
+					Source: source.Source, SourceAlias: source.SourceAlias, SourceSet: source.SourceSet,
+					Destination: containerIpv4, Protocol: port.Type, DestinationPort: uint16(port.PrivatePort),
+					DestinationAlias: ".",
+					Filter:           allowFilter(port),
+				}
+
+				rules = append(rules, &rule)
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// regenerate the rules of all allow lists; missing rules are added to the collection,
+// while rules that are no more generated are removed from it and returned
+// the boolean return value is true if there was any change
+func (c *IptablesRulesCollection) reconcileAllowRules(container *docker.Container) ([]*ActiveIptablesRule, bool, error) {
+	desired, err := c.allowRules(container)
+	if err != nil {
+		return nil, false, err
+	}
+
+	missing := map[string]*ActiveIptablesRule{}
+	keys := []string{}
+	for _, r := range desired {
+		key := r.Format() + "\n" + r.Aliases()
+		if _, ok := missing[key]; ok {
+			// same address specified more than once
+			continue
+		}
+		missing[key] = r
+		keys = append(keys, key)
+	}
+
+	changed := false
+	kept := []*ActiveIptablesRule{}
+	stale := []*ActiveIptablesRule{}
+	for _, r := range c.Rules {
+		if r.Origin != ALLOW_ORIGIN {
+			kept = append(kept, r)
+			continue
+		}
+
+		key := r.Format() + "\n" + r.Aliases()
+		d, ok := missing[key]
+		if !ok {
+			stale = append(stale, r)
+			changed = true
+			continue
+		}
+
+		if !sameExpiry(r.Expires, d.Expires) {
+			r.Expires = d.Expires
+			changed = true
+		}
+		delete(missing, key)
+		kept = append(kept, r)
+	}
+
+	for _, key := range keys {
+		if r, ok := missing[key]; ok {
+			kept = append(kept, r)
+			changed = true
+		}
+	}
+
+	c.Rules = kept
+	return stale, changed, nil
+}
+
+// regenerate the rules of all allow lists and apply the changes to iptables
+// new rules are added before stale ones are deleted
+func (c *IptablesRulesCollection) applyAllowRules(container *docker.Container) error {
+	stale, _, err := c.reconcileAllowRules(container)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range c.Rules {
+		if r.Origin != ALLOW_ORIGIN {
+			continue
+		}
+
+		rule := r.Format()
+		exists, err := RuleExists(rule)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			err := internalInsert(r.Position(), rule)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, r := range stale {
+		// attempt to delete, do not make a permanent failure
+		_ = internalDelete(r.Format(), true)
+	}
+
+	return nil
+}
+
+// forget allow lists left without addresses; for ipset-backed lists, the rules matching
+// the set are deleted before the set is destroyed
+func (c *IptablesRulesCollection) forgetEmptyAllowLists() error {
+	kept := []*AllowList{}
+	for _, l := range c.AllowLists {
+		if len(l.Addresses) != 0 {
+			kept = append(kept, l)
+			continue
+		}
+		if l.IpSet == "" {
+			continue
+		}
+
+		rules := []*ActiveIptablesRule{}
+		for _, r := range c.Rules {
+			if r.SourceSet != l.IpSet {
+				rules = append(rules, r)
+				continue
+			}
+			// attempt to delete, rule might be missing e.g. because container is not running
+			_ = internalDelete(r.Format(), true)
+		}
+		c.Rules = rules
+
+		exists, err := ipsetExists(l.IpSet)
+		if err != nil {
+			return err
+		}
+		if exists {
+			err := ipsetMustRun("destroy " + l.IpSet)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	c.AllowLists = kept
+
+	return nil
+}
+
+// normalize an address specified for 'allow'/'revoke' actions, as stored in allow lists
+func normalizeAllowedAddress(entry string) (string, error) {
+	entry = strings.Trim(entry, " ")
+	if isMultiAddressAlias(entry) {
+		return entry, nil
+	}
+	return normalizeNetworkAddress(entry)
+}
+
+// corresponding to a subcommand ('revoke')
+// remove addresses from the allow lists of a container, together with all the rules generated for them
+func RevokeExternal(cid string, addresses []string, dryRun bool) (int, error) {
+	container, err := ccl.LookupOnlineContainer(cid)
+	if err != nil {
+		return 1, err
+	}
+
+	c, err := LoadRules(container)
+	if err != nil {
+		return 2, err
+	}
+
+	revoked := []string{}
+	for _, entry := range addresses {
+		address, err := normalizeAllowedAddress(entry)
+		if err != nil {
+			return 3, err
+		}
+
+		found := false
+		for _, l := range c.AllowLists {
+			kept := []*AllowedAddress{}
+			for _, a := range l.Addresses {
+				if a.Address == address {
+					found = true
+					continue
+				}
+				kept = append(kept, a)
+			}
+			l.Addresses = kept
+		}
+		if !found {
+			return 3, errors.New(fmt.Sprintf("address '%s' is not allowed for container %s", entry, container.Name[1:]))
+		}
+		revoked = append(revoked, address)
+	}
+
+	// set members are removed in place
+	for _, l := range c.AllowLists {
+		if l.IpSet == "" {
+			continue
+		}
+		_, err := l.SyncIpSet(dryRun)
+		if err != nil {
+			return 4, err
+		}
+	}
+
+	stale, _, err := c.reconcileAllowRules(container)
+	if err != nil {
+		return 5, err
+	}
+	for _, r := range stale {
+		if dryRun {
+			fmt.Printf("docker-fw: iptables(%s): would delete rule '%s'\n", container.Name[1:], r.Format())
+			continue
+		}
+		// attempt to delete, do not make a permanent failure
+		_ = internalDelete(r.Format(), true)
+	}
+
+	if dryRun {
+		fmt.Printf("docker-fw: allow(%s): would revoke %s\n", container.Name[1:], strings.Join(revoked, ", "))
+		// report non-zero exit code since there would be changes
+		return 1, nil
+	}
+
+	// allow lists left empty are forgotten, together with their ipset
+	err = c.forgetEmptyAllowLists()
+	if err != nil {
+		return 6, err
+	}
+
+	err = c.Save()
+	if err != nil {
+		return 6, err
+	}
+
+	return 0, nil
+}
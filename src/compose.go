@@ -0,0 +1,102 @@
+/*
+ * docker-fw v0.2.4 - a complementary tool for Docker to manage custom
+ *                    firewall rules between/towards Docker containers
+ * Copyright (C) 2014~2016 gdm85 - https://github.com/gdm85/docker-fw/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// labels set by docker-compose on the containers it creates
+const (
+	COMPOSE_PROJECT_LABEL    = "com.docker.compose.project"
+	COMPOSE_SERVICE_LABEL    = "com.docker.compose.service"
+	COMPOSE_DEPENDS_ON_LABEL = "com.docker.compose.depends_on"
+)
+
+// ids of all containers (also stopped ones) matching all the specified 'key=value' labels
+func SelectContainersByLabels(labels []string) ([]string, error) {
+	for _, label := range labels {
+		if !strings.Contains(label, "=") || strings.HasPrefix(label, "=") {
+			return nil, errors.New(fmt.Sprintf("not a valid label selector '%s', must be in key=value format", label))
+		}
+	}
+
+	containers, err := Docker.ListContainers(docker.ListContainersOptions{All: true, Filters: map[string][]string{"label": labels}})
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, containerSummary := range containers {
+		ids = append(ids, containerSummary.ID)
+	}
+	return ids, nil
+}
+
+// containers of the same compose project that the container depends on, through 'depends_on'
+// label format is 'service:condition:restart', comma-separated
+func composeDependencies(container *docker.Container, skipUnresolved bool) ([]*docker.Container, error) {
+	if container.Config == nil {
+		return nil, nil
+	}
+	dependsOn := container.Config.Labels[COMPOSE_DEPENDS_ON_LABEL]
+	project := container.Config.Labels[COMPOSE_PROJECT_LABEL]
+	if dependsOn == "" || project == "" {
+		return nil, nil
+	}
+
+	dependencies := []*docker.Container{}
+	for _, entry := range strings.Split(dependsOn, ",") {
+		service := strings.SplitN(strings.TrimSpace(entry), ":", 2)[0]
+		if service == "" {
+			continue
+		}
+
+		ids, err := SelectContainersByLabels([]string{COMPOSE_PROJECT_LABEL + "=" + project, COMPOSE_SERVICE_LABEL + "=" + service})
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			err = unresolvedDependency(container, errors.New(fmt.Sprintf("container '%s' depends on service '%s' of project '%s', but no container exists for it", container.Name[1:], service, project)), skipUnresolved)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		for _, id := range ids {
+			dependency, err := ccl.LookupContainer(id)
+			if err != nil {
+				err = unresolvedDependency(container, err, skipUnresolved)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			dependencies = append(dependencies, dependency)
+		}
+	}
+	return dependencies, nil
+}
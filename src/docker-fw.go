@@ -27,14 +27,16 @@ import (
 	"log"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pborman/getopt"
 )
 
 const (
 	version   = "0.2.4"
-	ADDR_SPEC = "Can be either an IPv4 address, a subnet, one of the special aliases ('.' = container IPv4, '/' = docker host IPv4) or a container id. If an IPv4 address is specified and no subnet, '/32' will be added. Default is '.'"
+	ADDR_SPEC = "Can be either an IPv4 address, a subnet, one of the special aliases ('.' = container IPv4, '/' = docker host IPv4), a container id, 'dns:' followed by a hostname or '@' followed by an address group name (both resolved again on replay). If an IPv4 address is specified and no subnet, '/32' will be added. Default is '.'"
 	// directly from Docker
 	validContainerNameChars = `[a-zA-Z0-9][a-zA-Z0-9_.-]`
 )
@@ -42,9 +44,11 @@ const (
 type Action struct {
 	ContainerId                                                                                                             string
 	VerboseArg, SourceArg, SourcePortArg, DestArg, DestPortArg, ProtoArg, FilterArg, FromArg, ReverseLookupContainerIPv4Arg getopt.Option
+	TTLArg, ExpiresArg                                                                                                      getopt.Option
 	CommandSet                                                                                                              *getopt.Set
 
 	source, dest, proto, filter string
+	ttl, expires                string
 	reverseLookupContainerIPv4  bool
 	sourcePort, destPort        uint16
 	verbose                     bool
@@ -57,18 +61,20 @@ var (
 func NewAction(allowParseNames bool) *Action {
 	var a Action
 	a.CommandSet = getopt.New()
-	a.CommandSet.SetProgram("docker-fw (init|start|allow|add|add-input|add-two-ways|add-internal|ls|save-hostconfig|replay|drop) containerId")
-	a.CommandSet.SetParameters("\n\nSyntax for all add actions:\n\tdocker-fw (add|add-input|add-two-ways|add-internal) ...")
+	a.CommandSet.SetProgram("docker-fw (init|start|stop|restart|allow|add|add-input|add-two-ways|add-internal|add-egress|egress-policy|forward|doctor|serve|metrics|stats|graph|systemd-generate|ls|save-hostconfig|replay|drop|revoke|expire|learn|group) containerId")
+	a.CommandSet.SetParameters("\n\nSyntax for all add actions:\n\tdocker-fw (add|add-input|add-two-ways|add-internal|add-egress) ...")
 
 	a.VerboseArg = a.CommandSet.BoolVarLong(&a.verbose, "verbose", 'v', "use more verbose output, prints all iptables operations")
 
 	// define all command line options
 	a.SourceArg = a.CommandSet.StringVarLong(&a.source, "source", 's', "source-specification*", ".")
 	a.SourcePortArg = a.CommandSet.Uint16VarLong(&a.sourcePort, "sport", 0, "Source port, optional", "port")
-	a.DestArg = a.CommandSet.StringVarLong(&a.dest, "dest", 'd', "destination-specification*", ".")
+	a.DestArg = a.CommandSet.StringVarLong(&a.dest, "dest", 'd', "destination-specification*, mandatory for 'add-egress' action", ".")
 	a.DestPortArg = a.CommandSet.Uint16VarLong(&a.destPort, "dport", 0, "Destination port, mandatory only for 'add-input', 'add-two-ways' and 'add-internal' actions", "port")
 	a.ProtoArg = a.CommandSet.EnumVarLong(&a.proto, "protocol", 'p', []string{"tcp", "udp"}, "The protocol of the packet to check")
 	a.FilterArg = a.CommandSet.StringVarLong(&a.filter, "filter", 0, "extra iptables conditions")
+	a.TTLArg = a.CommandSet.StringVarLong(&a.ttl, "ttl", 0, "time-to-live of the rule, e.g. 4h; rule is removed by 'expire' action afterwards", "duration")
+	a.ExpiresArg = a.CommandSet.StringVarLong(&a.expires, "expires", 0, "expiry time of the rule (RFC3339); rule is removed by 'expire' action afterwards", "timestamp")
 	if allowParseNames {
 		a.ReverseLookupContainerIPv4Arg = a.CommandSet.BoolVarLong(&a.reverseLookupContainerIPv4, "rev-lookup", 0, "allow specifying addresses in 172.* subnet and map them back to container names")
 	}
@@ -80,11 +86,13 @@ func NewAction(allowParseNames bool) *Action {
 	a.sourcePort = 0
 	a.destPort = 0
 	a.filter = ""
+	a.ttl = ""
+	a.expires = ""
 
 	return &a
 }
 
-func (a *Action) CreateRule() (*IptablesRule, error) {
+func (a *Action) CreateRules() ([]*IptablesRule, error) {
 	return NewIptablesRule(a.ContainerId, a.source, a.sourcePort, a.dest, a.destPort, a.proto, a.filter, a.reverseLookupContainerIPv4)
 }
 
@@ -100,6 +108,14 @@ func (a *Action) Validate(action string) error {
 			return errors.New("--dport is mandatory")
 		}
 	}
+	if action == "add-egress" {
+		if !a.DestArg.Seen() {
+			return errors.New("--dest is mandatory")
+		}
+		if a.source != "." {
+			return errors.New("source of an egress rule must be the container itself ('.')")
+		}
+	}
 
 	//NOTE: enforcement of different source/destination happens in NewIptablesRule()
 
@@ -119,20 +135,51 @@ func (a *Action) Validate(action string) error {
 		return errors.New("Invalid source specification")
 	}
 
+	if _, err := parseExpiry(a.ttl, a.expires); err != nil {
+		return err
+	}
+
 	return nil
 }
 
-func runCommandsFromScanner(scanner *bufio.Scanner, action string) error {
+func runCommandsFromScanner(scanner *bufio.Scanner, action, containerId string) error {
 	lineNo := 0
 	for scanner.Scan() {
 		lineNo++
 
+		line := strings.TrimSpace(scanner.Text())
+		// skip empty lines and comments
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
 		// create a new 'commandLine' for each input line,
 		// but always use same action for all lines
 		commandLine := NewAction(false)
+		commandLine.ContainerId = containerId
+
+		// lines can also be in the format used by 'ls' and 'learn' output, e.g. with action and container id
+		fields := strings.Split(line, " ")
+		if strings.HasPrefix(fields[0], "add") {
+			if fields[0] != action {
+				return errors.New(fmt.Sprintf("%s: error at line %d: line is for action '%s'", action, lineNo, fields[0]))
+			}
+			fields = fields[1:]
+		}
+		if len(fields) > 0 && !strings.HasPrefix(fields[0], "-") {
+			if !containerIdMatch.MatchString(fields[0]) {
+				return errors.New(fmt.Sprintf("%s: error at line %d: not a valid container id: %s", action, lineNo, fields[0]))
+			}
+			commandLine.ContainerId = fields[0]
+			fields = fields[1:]
+		}
+		if commandLine.ContainerId == "" {
+			return errors.New(fmt.Sprintf("%s: error at line %d: no container id specified", action, lineNo))
+		}
+
 		// set executable name
 		newArgs := []string{os.Args[0]}
-		newArgs = append(newArgs, strings.Split(scanner.Text(), " ")...)
+		newArgs = append(newArgs, fields...)
 		if err := commandLine.Parse(newArgs); err != nil {
 			return errors.New(fmt.Sprintf("%s: error at line %d: %s", action, lineNo, err))
 		}
@@ -161,13 +208,33 @@ This is free software, and you are welcome to redistribute it
 under certain conditions`, version)
 	a.CommandSet.PrintUsage(os.Stdout)
 	fmt.Printf("\n* = %s\n", ADDR_SPEC)
-	fmt.Printf("\nSyntax for 'allow' action:\n\tdocker-fw allow address1 [address2] [address3] [...] [addressN]\nA list of IPv4 addresses is accepted\n\n")
+	fmt.Printf("\nSyntax for 'allow' action:\n\tdocker-fw allow [--ipset] [--ports=port1[/proto],...] [--ttl=duration|--expires=timestamp] containerId address1 [address2] [address3] [...] [addressN]\nA list of IPv4 addresses, subnets, '@group' and 'dns:hostname' aliases is accepted; option '--ipset' stores addresses in an ipset matched by a single rule per published port; option '--ports' restricts the addresses to a subset of the published host ports (protocol defaults to tcp)\n\n")
+	fmt.Printf("Syntax for 'group' action:\n\tdocker-fw group set name address1 [address2] [...] [addressN]\n\tdocker-fw group rm [--force] name\n\tdocker-fw group ls [name1] [...] [nameN]\nGroups of IPv4 addresses/subnets can be referenced as '@name' in any address specification and in 'allow' action; use 'replay' to apply membership changes; groups still referenced by rules are removed only with --force, which also removes such rules\n\n")
+	fmt.Printf("Syntax for 'init' action:\n\tdocker-fw init [--egress] [--check|--fix]\nSets up and verifies the FORWARD chain layout; option '--check' only reports deviations, option '--fix' also moves misplaced rules\n\n")
+	fmt.Printf("Syntax for 'serve' action:\n\tdocker-fw serve --socket=/run/docker-fw.sock\nExposes an HTTP/JSON API on a unix socket to list, add, drop and replay rules, allow/revoke addresses and start containers\n\n")
+	fmt.Printf("Syntax for 'metrics' action:\n\tdocker-fw metrics [--listen=127.0.0.1:9101]\nServes packet/byte counters of all recorded rules as Prometheus metrics on /metrics; use e.g. --listen=:9101 to listen on all interfaces\n\n")
+	fmt.Printf("Syntax for 'stats' action:\n\tdocker-fw stats [container1] [container2] [...] [containerN]\nDisplays packet/byte counters of all recorded rules of the specified containers (all if none specified)\n\n")
+	fmt.Printf("Syntax for 'doctor' action:\n\tdocker-fw doctor\nChecks Docker daemon, iptables, firewall layout and the state of all containers, printing a pass/warn/fail report with suggested fixes\n\n")
+	fmt.Printf("Syntax for 'forward' action:\n\tdocker-fw forward containerId --host-port=port --container-port=port [--host-ip=address] [--protocol=tcp|udp]\nForwards an additional host port (optionally of a specific host address) to a running container, with the matching filter accept\n\n")
+	fmt.Printf("Syntax for 'egress-policy' action:\n\tdocker-fw egress-policy containerId allow|deny\nWith 'deny', outbound traffic of the container is dropped unless whitelisted with 'add-egress'; requires 'init --egress'\n\n")
+	fmt.Printf("Syntax for 'revoke' action:\n\tdocker-fw revoke [--dry-run] containerId address1 [address2] [address3] [...] [addressN]\nRemoves addresses previously specified with 'allow', together with all the rules created for them\n\n")
+	fmt.Printf("Syntax for 'expire' action:\n\tdocker-fw expire [--dry-run]\nRemoves all rules whose time-to-live/expiry time has passed, for all containers\n\n")
 	fmt.Printf("Syntax for 'ls' action:\n\tdocker-fw ls [container1] [container2] [container3] [...] [containerN]\nA list of 0 or more container IDs/names is accepted\n\n")
 	fmt.Printf("Syntax for 'drop' action:\n\tdocker-fw drop container1 [container2] [container3] [...] [containerN]\nA list of container IDs/names is accepted\n\n")
 	fmt.Printf("Syntax for 'save-hostconfig' action:\n\tdocker-fw save-hostconfig container1 [container2] [container3] [...] [containerN]\nA list of container IDs/names is accepted\n\n")
 	fmt.Printf("Syntax for 'replay' action:\n\tdocker-fw replay [--dry-run] container1 [container2] [container3] [...] [containerN]\nA list of container IDs/names is accepted\n\n")
-	fmt.Printf("Syntax for 'start' action:\n\tdocker-fw start [--dry-run] [--paused] [--pull-deps] container1 [container2] [container3] [...] [containerN]\n")
-	fmt.Printf("A list of container IDs/names is accepted; option '--paused' allows to start containers in paused status, option '--pull-deps' allows to pull dependencies in selection, option --dry-run shows container names in the order they would be started without changing their state\n")
+	fmt.Printf("Syntax for 'learn' action:\n\tdocker-fw learn [--duration=5m] container1 [container2] [container3] [...] [containerN]\n")
+	fmt.Printf("Temporarily allows and logs all traffic towards the specified containers that would otherwise be dropped; when interrupted (or after the optional duration) prints the add actions that would allow the observed flows\n\n")
+	fmt.Printf("Syntax for 'start' action:\n\tdocker-fw start [--dry-run] [--paused|--hold-until-ready] [--pull-deps] [--parallel=N] [--wait] [--wait-timeout=1m] [--project=name] [--label=key=value] [container1] [container2] [container3] [...] [containerN]\n")
+	fmt.Printf("A list of container IDs/names is accepted, to which all containers matching the '--project' (docker-compose) and '--label' selectors are added; option '--paused' allows to start containers in paused status, option '--hold-until-ready' allows to start containers paused and unpause them once rules and custom hosts of all of them are in place, option '--pull-deps' allows to pull dependencies in selection, option '--parallel' allows to start up to N containers that do not depend on each other at the same time, option '--wait' allows to wait for containers to be ready before starting the containers depending on them, option --dry-run shows container names in the order they would be started without changing their state\n\n")
+	fmt.Printf("Syntax for 'graph' action:\n\tdocker-fw graph [--format=dot|json] [container1] [container2] [container3] [...] [containerN]\n")
+	fmt.Printf("Prints the dependencies between the specified containers (and their own dependencies), or between all containers if none specified, as used by 'start' action\n\n")
+	fmt.Printf("Syntax for 'systemd-generate' action:\n\tdocker-fw systemd-generate [--output=%s] (--all|container1 [container2] [container3] [...] [containerN])\n", SYSTEMD_UNITS_DIR)
+	fmt.Printf("Writes systemd units that run 'init' after Docker daemon, start the containers (and their dependencies) and replay their rules in dependency order; enable %s to run them at boot\n\n", SYSTEMD_TARGET)
+	fmt.Printf("Syntax for 'stop' action:\n\tdocker-fw stop [--dry-run] [--pull-dependents] [--time=10] container1 [container2] [container3] [...] [containerN]\n")
+	fmt.Printf("Containers are stopped before the containers they depend on; option '--pull-dependents' allows to also stop containers depending on the selected ones, option '--time' specifies the seconds to wait before killing each container\n\n")
+	fmt.Printf("Syntax for 'restart' action:\n\tdocker-fw restart [--dry-run] [--pull-dependents] [--time=10] [--parallel=N] container1 [container2] [container3] [...] [containerN]\n")
+	fmt.Printf("Same as 'stop' followed by 'start' of the same containers; dependencies not in selection are started if they are not running\n")
 }
 
 func (a *Action) ExecuteAddAction(action string) error {
@@ -176,28 +243,40 @@ func (a *Action) ExecuteAddAction(action string) error {
 		return err
 	}
 
-	rule, err := a.CreateRule()
+	rules, err := a.CreateRules()
 	if err != nil {
 		return err
 	}
 
-	if action == "add" {
-		if isDockerIPv4(rule.Source) && isDockerIPv4(rule.Destination) {
-			return errors.New("Trying to add an external firewall rule for internal Docker traffic")
-		}
+	expires, err := parseExpiry(a.ttl, a.expires)
+	if err != nil {
+		return err
+	}
 
-		err = AddFirewallRule(a.ContainerId, rule)
-	} else if action == "add-input" {
-		err = AddInputRule(a.ContainerId, rule)
-	} else if action == "add-internal" {
-		err = AddInternalRule(a.ContainerId, rule)
-	} else if action == "add-two-ways" {
-		err = AddTwoWays(a.ContainerId, rule)
-	} else {
-		// only add* actions are supported when importing from file
-		return errors.New("cannot execute this action: " + action)
+	for _, rule := range rules {
+		if action == "add" {
+			if isDockerIPv4(rule.Source) && isDockerIPv4(rule.Destination) {
+				return errors.New("Trying to add an external firewall rule for internal Docker traffic")
+			}
+
+			err = AddFirewallRule(a.ContainerId, rule, expires)
+		} else if action == "add-input" {
+			err = AddInputRule(a.ContainerId, rule, expires)
+		} else if action == "add-internal" {
+			err = AddInternalRule(a.ContainerId, rule, expires)
+		} else if action == "add-two-ways" {
+			err = AddTwoWays(a.ContainerId, rule, expires)
+		} else if action == "add-egress" {
+			err = AddEgressRule(a.ContainerId, rule, expires)
+		} else {
+			// only add* actions are supported when importing from file
+			return errors.New("cannot execute this action: " + action)
+		}
+		if err != nil {
+			return err
+		}
 	}
-	return err
+	return nil
 }
 
 var verboseOutput bool
@@ -216,52 +295,120 @@ func main() {
 	}
 
 	action := os.Args[1]
+
+	// serialise with other instances (and with 'serve') all actions that change state;
+	// the lock is released on exit
+	if lockedActions[action] {
+		_, err := acquireLock()
+		if err != nil {
+			log.Fatalf("%s: cannot acquire lock: %s", action, err)
+			return
+		}
+	}
+
+	// position of the first option for add actions
+	optionsStart := 3
 	switch action {
 	case "init":
-		if len(os.Args) == 3 {
-			if os.Args[2] == "--verbose" {
+		egress, check, fix := false, false, false
+		for _, arg := range os.Args[2:] {
+			switch arg {
+			case "--verbose":
 				verboseOutput = true
-			} else {
-				log.Fatal("init action takes no command line arguments (except --verbose)")
+			case "--egress":
+				egress = true
+			case "--check":
+				check = true
+			case "--fix":
+				fix = true
+			default:
+				log.Fatal("init action takes no command line arguments (except --verbose, --egress, --check and --fix)")
 				os.Exit(1)
 				return
 			}
 		}
-		if len(os.Args) > 3 {
-			log.Fatal("init action takes no command line arguments (except --verbose)")
+		if check && fix {
+			log.Fatal("init: --check and --fix are mutually exclusive")
 			os.Exit(1)
 			return
 		}
 
-		err := InitializeFirewall()
+		exitCode, err := InitializeFirewall(egress, check, fix)
 		if err != nil {
-			log.Fatalf("%s: %s", action, err)
-			return
+			log.Printf("%s: %s", action, err)
 		}
-
-		// success
-		os.Exit(0)
+		os.Exit(exitCode)
 		return
 	case "allow":
-		if len(os.Args) < 3 {
+		var ttl, expires string
+		opts := AllowOptions{}
+		args := []string{}
+		for i := 2; i < len(os.Args); i++ {
+			arg := os.Args[i]
+			if !strings.HasPrefix(arg, "--") {
+				args = append(args, arg)
+				continue
+			}
+			if arg == "--ipset" {
+				opts.IpSet = true
+				continue
+			}
+
+			// options accept their value either after '=' or as next argument
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) == 1 {
+				if i+1 == len(os.Args) {
+					log.Fatalf("%s: missing value for option: %s", action, arg)
+					return
+				}
+				i++
+				parts = append(parts, os.Args[i])
+			}
+
+			switch parts[0] {
+			case "--ttl":
+				ttl = parts[1]
+			case "--expires":
+				expires = parts[1]
+			case "--ports":
+				var err error
+				opts.Ports, err = parseAllowedPorts(parts[1])
+				if err != nil {
+					log.Fatalf("%s: %s", action, err)
+					return
+				}
+			default:
+				log.Fatalf("%s: unknown option: %s", action, arg)
+				return
+			}
+		}
+
+		if len(args) < 1 {
 			log.Fatalf("%s: no container id specified", action)
 			os.Exit(1)
 			return
 		}
-		if len(os.Args) < 4 {
+		if len(args) < 2 {
 			log.Fatalf("%s: no whitelist addresses specified", action)
 			os.Exit(1)
 			return
 		}
 		// pick container id
-		containerId := os.Args[2]
+		containerId := args[0]
 
 		if !containerIdMatch.MatchString(containerId) {
 			log.Fatalf("not a valid container id: %s", containerId)
 			return
 		}
 
-		err := AllowExternal(containerId, os.Args[3:])
+		var err error
+		opts.Expires, err = parseExpiry(ttl, expires)
+		if err != nil {
+			log.Fatalf("%s: %s", action, err)
+			return
+		}
+
+		err = AllowExternal(containerId, args[1:], &opts)
 		// parse error
 		if err != nil {
 			log.Printf("%s: %s", action, err)
@@ -277,21 +424,64 @@ func main() {
 			return
 		}
 		containerIds := []string{}
-		paused := false
-		dryRun := false
-		pullDeps := false
-		for _, arg := range os.Args[2:] {
+		labels := []string{}
+		opts := StartOptions{Parallel: 1, WaitTimeout: DEFAULT_WAIT_TIMEOUT}
+		for i := 2; i < len(os.Args); i++ {
+			arg := os.Args[i]
+
+			// options with a value accept it either after '=' or as next argument
+			if arg == "--project" || arg == "--label" || arg == "--parallel" || arg == "--wait-timeout" {
+				if i+1 == len(os.Args) {
+					log.Fatalf("%s: missing value for option: %s", action, arg)
+					return
+				}
+				i++
+				arg += "=" + os.Args[i]
+			}
+			if strings.HasPrefix(arg, "--project=") {
+				labels = append(labels, COMPOSE_PROJECT_LABEL+"="+arg[len("--project="):])
+				continue
+			}
+			if strings.HasPrefix(arg, "--label=") {
+				labels = append(labels, arg[len("--label="):])
+				continue
+			}
+			if strings.HasPrefix(arg, "--parallel=") {
+				parallel, err := strconv.Atoi(arg[len("--parallel="):])
+				if err != nil || parallel < 1 {
+					log.Fatalf("%s: invalid number of containers to start in parallel: %s", action, arg[len("--parallel="):])
+					return
+				}
+				opts.Parallel = parallel
+				continue
+			}
+			if strings.HasPrefix(arg, "--wait-timeout=") {
+				timeout, err := time.ParseDuration(arg[len("--wait-timeout="):])
+				if err != nil || timeout <= 0 {
+					log.Fatalf("%s: invalid timeout: %s", action, arg[len("--wait-timeout="):])
+					return
+				}
+				opts.WaitTimeout = timeout
+				continue
+			}
+
 			// is the famous '--paused' option?
 			if strings.HasPrefix(arg, "--") {
 				switch arg {
 				case "--paused":
-					paused = true
+					opts.Paused = true
 					break
 				case "--dry-run":
-					dryRun = true
+					opts.DryRun = true
 					break
 				case "--pull-deps":
-					pullDeps = true
+					opts.PullDeps = true
+					break
+				case "--wait":
+					opts.Wait = true
+					break
+				case "--hold-until-ready":
+					opts.HoldUntilReady = true
 					break
 				default:
 					log.Fatalf("%s: unknown option: %s", action, arg)
@@ -309,13 +499,119 @@ func main() {
 			containerIds = append(containerIds, arg)
 		}
 
-		exitCode, err := StartContainers(containerIds, paused, pullDeps, dryRun)
+		// containers matching all selectors are added to the list
+		if len(labels) != 0 {
+			selected, err := SelectContainersByLabels(labels)
+			if err != nil {
+				log.Fatalf("%s: %s", action, err)
+				return
+			}
+			if len(selected) == 0 {
+				log.Fatalf("%s: no containers match %s", action, strings.Join(labels, ", "))
+				return
+			}
+			for _, id := range selected {
+				if !inArray(containerIds, id) {
+					containerIds = append(containerIds, id)
+				}
+			}
+		}
+		if len(containerIds) == 0 {
+			log.Fatalf("%s: no container ids specified", action)
+			return
+		}
+		if opts.Wait && (opts.Paused || opts.HoldUntilReady) {
+			log.Fatalf("%s: paused containers cannot become ready, --wait cannot be used with --paused or --hold-until-ready", action)
+			return
+		}
+		if opts.Paused && opts.HoldUntilReady {
+			log.Fatalf("%s: --paused and --hold-until-ready cannot be used together", action)
+			return
+		}
+
+		exitCode, err := StartContainers(containerIds, &opts)
 		// parse error
 		if err != nil {
 			log.Printf("%s: %s", action, err)
 		}
 		os.Exit(exitCode)
 		return
+	case "stop", "restart":
+		containerIds := []string{}
+		stopOpts := StopOptions{Timeout: DEFAULT_STOP_TIMEOUT}
+		startOpts := StartOptions{Parallel: 1}
+		for i := 2; i < len(os.Args); i++ {
+			arg := os.Args[i]
+
+			// options with a value accept it either after '=' or as next argument
+			if arg == "--time" || (action == "restart" && arg == "--parallel") {
+				if i+1 == len(os.Args) {
+					log.Fatalf("%s: missing value for option: %s", action, arg)
+					return
+				}
+				i++
+				arg += "=" + os.Args[i]
+			}
+			if strings.HasPrefix(arg, "--time=") {
+				timeout, err := strconv.ParseUint(arg[len("--time="):], 10, 32)
+				if err != nil {
+					log.Fatalf("%s: invalid number of seconds: %s", action, arg[len("--time="):])
+					return
+				}
+				stopOpts.Timeout = uint(timeout)
+				continue
+			}
+			if action == "restart" && strings.HasPrefix(arg, "--parallel=") {
+				parallel, err := strconv.Atoi(arg[len("--parallel="):])
+				if err != nil || parallel < 1 {
+					log.Fatalf("%s: invalid number of containers to start in parallel: %s", action, arg[len("--parallel="):])
+					return
+				}
+				startOpts.Parallel = parallel
+				continue
+			}
+
+			if strings.HasPrefix(arg, "--") {
+				switch arg {
+				case "--dry-run":
+					stopOpts.DryRun = true
+					startOpts.DryRun = true
+					break
+				case "--pull-dependents":
+					stopOpts.PullDependents = true
+					break
+				default:
+					log.Fatalf("%s: unknown option: %s", action, arg)
+					return
+				}
+
+				continue
+			}
+
+			// pick container id
+			if !containerIdMatch.MatchString(arg) {
+				log.Fatalf("not a valid container id: %s", arg)
+				return
+			}
+			containerIds = append(containerIds, arg)
+		}
+		if len(containerIds) == 0 {
+			log.Fatalf("%s: no container ids specified", action)
+			return
+		}
+
+		var exitCode int
+		var err error
+		if action == "stop" {
+			exitCode, err = StopContainers(containerIds, &stopOpts)
+		} else {
+			exitCode, err = RestartContainers(containerIds, &stopOpts, &startOpts)
+		}
+		if err != nil {
+			log.Printf("%s: %s", action, err)
+		}
+		os.Exit(exitCode)
+		return
 	case "replay":
 		if len(os.Args) < 3 {
 			log.Fatalf("%s: insufficient command line arguments specified", action)
@@ -355,6 +651,381 @@ func main() {
 
 		os.Exit(exitCode)
 		return
+	case "group":
+		if len(os.Args) < 3 {
+			log.Fatalf("%s: no group action specified", action)
+			os.Exit(1)
+			return
+		}
+
+		var err error
+		switch os.Args[2] {
+		case "set":
+			if len(os.Args) < 5 {
+				log.Fatalf("%s: group name and at least one address must be specified", action)
+				os.Exit(1)
+				return
+			}
+			err = SetAddressGroup(os.Args[3], os.Args[4:])
+		case "rm":
+			force := false
+			names := []string{}
+			for _, arg := range os.Args[3:] {
+				if arg == "--force" {
+					force = true
+					continue
+				}
+				names = append(names, arg)
+			}
+			if len(names) != 1 {
+				log.Fatalf("%s: exactly one group name must be specified", action)
+				os.Exit(1)
+				return
+			}
+			err = RemoveAddressGroup(names[0], force)
+		case "ls":
+			err = ListAddressGroups(os.Args[3:])
+		default:
+			log.Fatalf("%s: unknown group action: %s", action, os.Args[2])
+			return
+		}
+		if err != nil {
+			log.Printf("%s: %s", action, err)
+			os.Exit(2)
+			return
+		}
+
+		os.Exit(0)
+		return
+	case "revoke":
+		dryRun := false
+		args := []string{}
+		for _, arg := range os.Args[2:] {
+			if arg == "--dry-run" {
+				dryRun = true
+				continue
+			}
+			args = append(args, arg)
+		}
+
+		if len(args) < 1 {
+			log.Fatalf("%s: no container id specified", action)
+			os.Exit(1)
+			return
+		}
+		if len(args) < 2 {
+			log.Fatalf("%s: no addresses specified", action)
+			os.Exit(1)
+			return
+		}
+		// pick container id
+		containerId := args[0]
+
+		if !containerIdMatch.MatchString(containerId) {
+			log.Fatalf("not a valid container id: %s", containerId)
+			return
+		}
+
+		exitCode, err := RevokeExternal(containerId, args[1:], dryRun)
+		if err != nil {
+			log.Printf("%s: %s", action, err)
+		}
+		os.Exit(exitCode)
+		return
+	case "forward":
+		opts := ForwardOptions{Protocol: "tcp"}
+		args := []string{}
+		for i := 2; i < len(os.Args); i++ {
+			arg := os.Args[i]
+			if !strings.HasPrefix(arg, "--") {
+				args = append(args, arg)
+				continue
+			}
+
+			// options accept their value either after '=' or as next argument
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) == 1 {
+				if i+1 == len(os.Args) {
+					log.Fatalf("%s: missing value for option: %s", action, arg)
+					return
+				}
+				i++
+				parts = append(parts, os.Args[i])
+			}
+
+			switch parts[0] {
+			case "--host-ip":
+				opts.HostIp = parts[1]
+			case "--host-port", "--container-port":
+				port, err := strconv.ParseUint(parts[1], 10, 16)
+				if err != nil {
+					log.Fatalf("%s: not a valid port: %s", action, parts[1])
+					return
+				}
+				if parts[0] == "--host-port" {
+					opts.HostPort = uint16(port)
+				} else {
+					opts.ContainerPort = uint16(port)
+				}
+			case "--protocol":
+				opts.Protocol = parts[1]
+			default:
+				log.Fatalf("%s: unknown option: %s", action, arg)
+				return
+			}
+		}
+
+		if len(args) != 1 {
+			log.Fatalf("%s: a single container id must be specified", action)
+			os.Exit(1)
+			return
+		}
+		// pick container id
+		containerId := args[0]
+
+		if !containerIdMatch.MatchString(containerId) {
+			log.Fatalf("not a valid container id: %s", containerId)
+			return
+		}
+
+		err := AddForward(containerId, &opts)
+		if err != nil {
+			log.Printf("%s: %s", action, err)
+			os.Exit(2)
+			return
+		}
+		os.Exit(0)
+		return
+	case "serve":
+		socketPath := ""
+		for i := 2; i < len(os.Args); i++ {
+			arg := os.Args[i]
+			if strings.HasPrefix(arg, "--socket=") {
+				socketPath = arg[len("--socket="):]
+			} else if arg == "--socket" && i+1 < len(os.Args) {
+				i++
+				socketPath = os.Args[i]
+			} else {
+				log.Fatalf("%s: unknown option: %s", action, arg)
+				return
+			}
+		}
+		if socketPath == "" {
+			log.Fatalf("%s: --socket is mandatory", action)
+			return
+		}
+
+		err := Serve(socketPath)
+		if err != nil {
+			log.Fatalf("%s: %s", action, err)
+			return
+		}
+		os.Exit(0)
+		return
+	case "metrics":
+		address := "127.0.0.1:9101"
+		for i := 2; i < len(os.Args); i++ {
+			arg := os.Args[i]
+			if strings.HasPrefix(arg, "--listen=") {
+				address = arg[len("--listen="):]
+			} else if arg == "--listen" && i+1 < len(os.Args) {
+				i++
+				address = os.Args[i]
+			} else {
+				log.Fatalf("%s: unknown option: %s", action, arg)
+				return
+			}
+		}
+
+		err := ServeMetrics(address)
+		if err != nil {
+			log.Fatalf("%s: %s", action, err)
+			return
+		}
+		os.Exit(0)
+		return
+	case "stats":
+		containerIds := []string{}
+		for _, arg := range os.Args[2:] {
+			if !containerIdMatch.MatchString(arg) {
+				log.Fatalf("not a valid container id: %s", arg)
+				return
+			}
+			containerIds = append(containerIds, arg)
+		}
+
+		err := ShowStats(containerIds)
+		if err != nil {
+			log.Fatalf("%s: %s", action, err)
+			return
+		}
+		os.Exit(0)
+		return
+	case "graph":
+		format := "dot"
+		containerIds := []string{}
+		for i := 2; i < len(os.Args); i++ {
+			arg := os.Args[i]
+			if arg == "--format" {
+				if i+1 == len(os.Args) {
+					log.Fatalf("%s: missing value for option: %s", action, arg)
+					return
+				}
+				i++
+				arg += "=" + os.Args[i]
+			}
+			if strings.HasPrefix(arg, "--format=") {
+				format = arg[len("--format="):]
+				continue
+			}
+			if strings.HasPrefix(arg, "--") {
+				log.Fatalf("%s: unknown option: %s", action, arg)
+				return
+			}
+
+			if !containerIdMatch.MatchString(arg) {
+				log.Fatalf("not a valid container id: %s", arg)
+				return
+			}
+			containerIds = append(containerIds, arg)
+		}
+
+		err := PrintGraph(os.Stdout, containerIds, format)
+		if err != nil {
+			log.Fatalf("%s: %s", action, err)
+			return
+		}
+		os.Exit(0)
+		return
+	case "systemd-generate":
+		all := false
+		outputDir := SYSTEMD_UNITS_DIR
+		containerIds := []string{}
+		for i := 2; i < len(os.Args); i++ {
+			arg := os.Args[i]
+			if arg == "--output" {
+				if i+1 == len(os.Args) {
+					log.Fatalf("%s: missing value for option: %s", action, arg)
+					return
+				}
+				i++
+				arg += "=" + os.Args[i]
+			}
+			if strings.HasPrefix(arg, "--output=") {
+				outputDir = arg[len("--output="):]
+				continue
+			}
+			if arg == "--all" {
+				all = true
+				continue
+			}
+			if strings.HasPrefix(arg, "--") {
+				log.Fatalf("%s: unknown option: %s", action, arg)
+				return
+			}
+
+			if !containerIdMatch.MatchString(arg) {
+				log.Fatalf("not a valid container id: %s", arg)
+				return
+			}
+			containerIds = append(containerIds, arg)
+		}
+		if all == (len(containerIds) != 0) {
+			log.Fatalf("%s: either --all or a list of containers must be specified", action)
+			return
+		}
+
+		err := GenerateSystemdUnits(containerIds, outputDir)
+		if err != nil {
+			log.Fatalf("%s: %s", action, err)
+			return
+		}
+		os.Exit(0)
+		return
+	case "doctor":
+		if len(os.Args) != 2 {
+			log.Fatalf("%s action takes no command line arguments", action)
+			os.Exit(1)
+			return
+		}
+
+		os.Exit(RunDoctor())
+		return
+	case "egress-policy":
+		if len(os.Args) != 4 {
+			log.Fatalf("%s: container id and policy (allow|deny) must be specified", action)
+			os.Exit(1)
+			return
+		}
+		// pick container id
+		containerId := os.Args[2]
+
+		if !containerIdMatch.MatchString(containerId) {
+			log.Fatalf("not a valid container id: %s", containerId)
+			return
+		}
+
+		err := SetEgressPolicy(containerId, os.Args[3])
+		if err != nil {
+			log.Printf("%s: %s", action, err)
+			os.Exit(2)
+			return
+		}
+		os.Exit(0)
+		return
+	case "expire":
+		dryRun := false
+		for _, arg := range os.Args[2:] {
+			if arg != "--dry-run" {
+				log.Fatalf("%s: unknown option: %s", action, arg)
+				return
+			}
+			dryRun = true
+		}
+
+		exitCode, err := ExpireRules(dryRun)
+		if err != nil {
+			log.Printf("%s: %s", action, err)
+		}
+		os.Exit(exitCode)
+		return
+	case "learn":
+		var duration time.Duration
+		containerIds := []string{}
+		for _, arg := range os.Args[2:] {
+			if strings.HasPrefix(arg, "--duration=") {
+				var err error
+				duration, err = time.ParseDuration(arg[len("--duration="):])
+				if err != nil || duration <= 0 {
+					log.Fatalf("%s: invalid duration: %s", action, arg)
+					return
+				}
+				continue
+			}
+
+			// pick container id
+			if !containerIdMatch.MatchString(arg) {
+				log.Fatalf("not a valid container id: %s", arg)
+				return
+			}
+			containerIds = append(containerIds, arg)
+		}
+
+		if len(containerIds) == 0 {
+			log.Fatalf("%s: no containers specified", action)
+			os.Exit(1)
+			return
+		}
+
+		err := LearnRules(containerIds, duration)
+		if err != nil {
+			log.Printf("%s: %s", action, err)
+			os.Exit(2)
+			return
+		}
+
+		os.Exit(0)
+		return
 	case "ls":
 		containerIds := []string{}
 		for _, arg := range os.Args[2:] {
@@ -408,13 +1079,19 @@ func main() {
 
 		os.Exit(0)
 		return
-	case "add-two-ways", "add-internal", "add", "add-input":
+	case "add-two-ways", "add-internal", "add", "add-input", "add-egress":
 		if len(os.Args) < 3 {
 			log.Fatalf("%s: no container id specified", action)
 			os.Exit(1)
 			return
 		}
 
+		// container id can be omitted when reading commands that specify it
+		if strings.HasPrefix(os.Args[2], "--from") {
+			optionsStart = 2
+			break
+		}
+
 		// pick container id
 		containerId := os.Args[2]
 		cliArgs.ContainerId = containerId
@@ -431,7 +1108,7 @@ func main() {
 
 	// parse all except those already manually parsed
 	newArgs := []string{os.Args[0]}
-	newArgs = append(newArgs, os.Args[3:]...)
+	newArgs = append(newArgs, os.Args[optionsStart:]...)
 	if err := cliArgs.Parse(newArgs); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		cliArgs.Usage()
@@ -441,6 +1118,11 @@ func main() {
 
 	// if a source for a list of actions is not specified, take a shortcut to direct action processing
 	if !fromArg.Seen() {
+		if cliArgs.ContainerId == "" {
+			log.Fatalf("%s: no container id specified", action)
+			return
+		}
+
 		err := cliArgs.ExecuteAddAction(action)
 		if err != nil {
 			log.Fatalf("%s: %s", action, err)
@@ -451,7 +1133,7 @@ func main() {
 		os.Exit(0)
 	}
 
-	if cliArgs.SourceArg.Seen() || cliArgs.SourcePortArg.Seen() || cliArgs.DestArg.Seen() || cliArgs.DestPortArg.Seen() || cliArgs.ProtoArg.Seen() || cliArgs.FilterArg.Seen() {
+	if cliArgs.SourceArg.Seen() || cliArgs.SourcePortArg.Seen() || cliArgs.DestArg.Seen() || cliArgs.DestPortArg.Seen() || cliArgs.ProtoArg.Seen() || cliArgs.FilterArg.Seen() || cliArgs.TTLArg.Seen() || cliArgs.ExpiresArg.Seen() {
 		log.Fatal("When using --from, only '--rev-lookup' is allowed")
 		return
 	}
@@ -459,11 +1141,11 @@ func main() {
 	// read all commands line by line from stdin
 	var err error
 	if from == "-" {
-		err = runCommandsFromScanner(bufio.NewScanner(os.Stdin), action)
+		err = runCommandsFromScanner(bufio.NewScanner(os.Stdin), action, cliArgs.ContainerId)
 	} else {
 		file, err := os.Open(from)
 		if err == nil {
-			err = runCommandsFromScanner(bufio.NewScanner(file), action)
+			err = runCommandsFromScanner(bufio.NewScanner(file), action, cliArgs.ContainerId)
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -0,0 +1,246 @@
+/*
+ * docker-fw v0.2.4 - a complementary tool for Docker to manage custom
+ *                    firewall rules between/towards Docker containers
+ * Copyright (C) 2014~2016 gdm85 - https://github.com/gdm85/docker-fw/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	DOCTOR_PASS = "pass"
+	DOCTOR_WARN = "warn"
+	DOCTOR_FAIL = "fail"
+)
+
+type doctorFinding struct {
+	Status  string
+	Subject string
+	Message string
+	Fix     string // optional, suggested fix
+}
+
+type doctorReport struct {
+	findings []*doctorFinding
+}
+
+func (r *doctorReport) add(status, subject, message, fix string) {
+	r.findings = append(r.findings, &doctorFinding{Status: status, Subject: subject, Message: message, Fix: fix})
+}
+
+// exit code is 2 if any check failed, 1 if there were only warnings
+func (r *doctorReport) Print() int {
+	exitCode := 0
+	for _, f := range r.findings {
+		fmt.Printf("[%s] %s: %s\n", f.Status, f.Subject, f.Message)
+		if f.Fix != "" {
+			fmt.Printf("       fix: %s\n", f.Fix)
+		}
+
+		if f.Status == DOCTOR_FAIL {
+			exitCode = 2
+		} else if f.Status == DOCTOR_WARN && exitCode == 0 {
+			exitCode = 1
+		}
+	}
+	return exitCode
+}
+
+// returns false if iptables cannot be run at all
+func (r *doctorReport) checkIptables() bool {
+	exitCode, stdo, _, err := iptablesRun("--version", true)
+	if err != nil || exitCode != 0 {
+		r.add(DOCTOR_FAIL, "iptables", "cannot run iptables", "install iptables and run docker-fw as root")
+		return false
+	}
+
+	version := strings.TrimSpace(stdo)
+	if strings.Contains(version, "nf_tables") {
+		r.add(DOCTOR_WARN, "iptables", version+" uses the nft backend, rules added by Docker through legacy iptables would not be visible",
+			"make sure Docker and docker-fw use the same iptables backend (e.g. 'update-alternatives --set iptables /usr/sbin/iptables-legacy')")
+		return true
+	}
+	r.add(DOCTOR_PASS, "iptables", version, "")
+	return true
+}
+
+func (r *doctorReport) checkLayout() {
+	findings, err := checkLayout(false)
+	if err != nil {
+		r.add(DOCTOR_FAIL, "layout", err.Error(), "start Docker daemon with iptables enabled")
+		return
+	}
+
+	icc := false
+	for _, f := range findings {
+		if f.Kind == LAYOUT_FINDING_ICC {
+			// added by Docker only when running with --icc=true
+			r.add(DOCTOR_FAIL, "icc", "Docker daemon is running with --icc=true, all internal traffic is accepted",
+				"restart Docker daemon with --icc=false, then run 'docker-fw init'")
+			icc = true
+		} else if f.Reorder {
+			r.add(DOCTOR_WARN, "layout", f.Problem, "docker-fw init --fix")
+		} else if f.Kind == LAYOUT_FINDING_DOCKER_LINK {
+			r.add(DOCTOR_FAIL, "layout", f.Problem+" (was Docker daemon restarted?)", "docker-fw init")
+		} else {
+			r.add(DOCTOR_FAIL, "layout", f.Problem, "docker-fw init")
+		}
+	}
+	if !icc {
+		r.add(DOCTOR_PASS, "icc", "inter-container communication is not accepted by default", "")
+	}
+	if len(findings) == 0 || (icc && len(findings) == 1) {
+		r.add(DOCTOR_PASS, "layout", "FORWARD chain layout is as expected", "")
+	}
+}
+
+func (r *doctorReport) checkGroups() {
+	_, err := LoadAddressGroups()
+	if err != nil {
+		r.add(DOCTOR_FAIL, "groups", fmt.Sprintf("cannot load %s: %s", GROUPS_FILE, err), "fix or remove "+GROUPS_FILE)
+		return
+	}
+	r.add(DOCTOR_PASS, "groups", "address groups can be loaded", "")
+}
+
+// verify the docker-fw state of a single container; aliases are resolved only for running containers
+func (r *doctorReport) checkContainer(container *docker.Container) {
+	name := container.Name[1:]
+	subject := "container " + name
+	failed := len(r.findings)
+
+	c, err := LoadRules(container)
+	if err != nil {
+		fileName := (&IptablesRulesCollection{cid: container.ID}).fileName()
+		r.add(DOCTOR_FAIL, subject, fmt.Sprintf("cannot load %s: %s", fileName, err), "fix or remove "+fileName)
+		c = nil
+	}
+
+	ch, err := LoadCustomHosts(container)
+	if err != nil {
+		r.add(DOCTOR_FAIL, subject, fmt.Sprintf("cannot load %s: %s", getCustomHostsFileName(container), err), "fix or remove "+getCustomHostsFileName(container))
+	} else {
+		for _, host := range ch {
+			_, err := ccl.LookupContainer(host)
+			if err != nil {
+				r.add(DOCTOR_WARN, subject, fmt.Sprintf("two-ways host '%s' does not exist anymore", host), "remove it from "+getCustomHostsFileName(container))
+			}
+		}
+	}
+
+	hostConfig, err := fetchSavedHostConfig(container.ID)
+	if err != nil {
+		r.add(DOCTOR_FAIL, subject, fmt.Sprintf("cannot load %s: %s", getBackupHostConfigFileName(container.ID), err), "docker-fw save-hostconfig "+name)
+	} else if hostConfig == nil && container.State.Running {
+		r.add(DOCTOR_WARN, subject, "no saved host configuration, 'start' would not restore it", "docker-fw save-hostconfig "+name)
+	}
+
+	if c != nil && container.State.Running {
+		r.checkAliases(container, c)
+	}
+
+	if len(r.findings) == failed {
+		r.add(DOCTOR_PASS, subject, fmt.Sprintf("%d rule(s), state files can be loaded", len(c.Rules)), "")
+	}
+}
+
+func (r *doctorReport) checkAliases(container *docker.Container, c *IptablesRulesCollection) {
+	name := container.Name[1:]
+	subject := "container " + name
+
+	checked := map[string]bool{}
+	outdated := false
+	for _, rule := range c.Rules {
+		for _, pair := range [][2]string{{rule.SourceAlias, rule.Source}, {rule.DestinationAlias, rule.Destination}} {
+			alias, address := pair[0], pair[1]
+			if alias == "" {
+				continue
+			}
+
+			addresses, _, err := ccl.ParseAddresses(alias, container, false)
+			if err != nil {
+				if !checked[alias] {
+					r.add(DOCTOR_FAIL, subject, fmt.Sprintf("alias '%s' does not resolve: %s", alias, err), "start the referenced container, or drop the rules of "+name)
+				}
+				checked[alias] = true
+				continue
+			}
+			checked[alias] = true
+
+			if !inArray(addresses, address) {
+				outdated = true
+			}
+		}
+	}
+	if outdated {
+		r.add(DOCTOR_WARN, subject, "some aliases resolve to different addresses than the ones of current rules", "docker-fw replay "+name)
+	}
+
+	for _, l := range c.AllowLists {
+		for _, a := range l.Addresses {
+			_, _, err := parseExternalAddress(a.Address)
+			if err != nil {
+				r.add(DOCTOR_FAIL, subject, fmt.Sprintf("allowed address '%s' does not resolve: %s", a.Address, err), "docker-fw revoke "+name+" "+a.Address)
+			}
+		}
+	}
+}
+
+// corresponding to a subcommand ('doctor')
+// run all environment checks and print a report, with a suggested fix for each finding
+func RunDoctor() int {
+	report := doctorReport{}
+
+	err := Docker.Ping()
+	if err != nil {
+		report.add(DOCTOR_FAIL, "daemon", "Docker daemon is not reachable: "+err.Error(), "start Docker daemon, or check DOCKER_HOST")
+		return report.Print()
+	}
+	report.add(DOCTOR_PASS, "daemon", "Docker daemon is reachable", "")
+
+	if report.checkIptables() {
+		report.checkLayout()
+	}
+	report.checkGroups()
+
+	err = ccl.LoadAllContainers()
+	if err != nil {
+		report.add(DOCTOR_FAIL, "containers", "cannot list containers: "+err.Error(), "")
+		return report.Print()
+	}
+
+	containers := ccl.GetAllContainers()
+	sort.Sort(byName(containers))
+	for _, container := range containers {
+		report.checkContainer(container)
+	}
+
+	return report.Print()
+}
+
+type byName []*docker.Container
+
+func (a byName) Len() int           { return len(a) }
+func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byName) Less(i, j int) bool { return a[i].Name < a[j].Name }
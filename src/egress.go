@@ -0,0 +1,255 @@
+/*
+ * docker-fw v0.2.4 - a complementary tool for Docker to manage custom
+ *                    firewall rules between/towards Docker containers
+ * Copyright (C) 2014~2016 gdm85 - https://github.com/gdm85/docker-fw/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	EGRESS_CHAIN        = "DOCKER-EGRESS"
+	EGRESS_ORIGIN       = "egress-policy"
+	EGRESS_POLICY_ALLOW = "allow"
+	EGRESS_POLICY_DENY  = "deny"
+)
+
+// outbound traffic of a container is dispatched from DOCKER-EGRESS to its own chain
+// chain names can be at most 28 characters
+func egressChain(cid string) string {
+	return EGRESS_CHAIN + "-" + cid[:12]
+}
+
+func isEgressChain(chain string) bool {
+	return strings.HasPrefix(chain, EGRESS_CHAIN+"-")
+}
+
+func chainExists(chain string) (bool, error) {
+	exitCode, _, _, err := iptablesRun("--wait -n -L "+chain, true)
+	if err != nil {
+		return false, err
+	}
+	return exitCode == 0, nil
+}
+
+// create chain if it does not exist yet; returns true if the chain was (or would be) created
+func ensureChain(chain string, dryRun bool) (bool, error) {
+	exists, err := chainExists(chain)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+
+	if dryRun {
+		fmt.Printf("docker-fw: iptables: would create chain '%s'\n", chain)
+		return true, nil
+	}
+
+	exitCode, stdo, stde, err := iptablesRun("--wait -N "+chain, false)
+	if err != nil {
+		return false, err
+	}
+	if exitCode != 0 {
+		fmt.Fprintln(os.Stdout, stdo)
+		fmt.Fprintln(os.Stderr, stde)
+		return false, errors.New(fmt.Sprintf("cannot create chain '%s'", chain))
+	}
+	return true, nil
+}
+
+// flush and delete a chain, used when dropping the rules of a container
+func removeChain(chain string) {
+	// attempt to remove, do not make a permanent failure
+	_, _, _, _ = iptablesRun("--wait -F "+chain, false)
+	_, _, _, _ = iptablesRun("--wait -X "+chain, false)
+}
+
+// corresponding to 'init --egress'
+// outbound traffic from containers is sent through DOCKER-EGRESS before the default accept,
+// established connections are returned immediately
+func initializeEgress() error {
+	_, err := ensureChain(EGRESS_CHAIN, false)
+	if err != nil {
+		return err
+	}
+
+	rule := EGRESS_CHAIN + " -m conntrack --ctstate RELATED,ESTABLISHED -j RETURN"
+	err = internalInsert(1, rule)
+	if err != nil {
+		return err
+	}
+
+	// NOTE: the Docker-added "-i docker0 ! -o docker0 -j ACCEPT" must come after this rule, while the internal
+	// link must stay on top since the FORWARD rules of containers are inserted right after it
+	return insertAfterInternalLink(LAYOUT_EGRESS_LINK)
+}
+
+// rules that implement the egress policy of the container: the dispatch from DOCKER-EGRESS and,
+// when outbound traffic is denied by default, the terminal drop of the container chain
+func egressPolicyRules(container *docker.Container, policy string) []*ActiveIptablesRule {
+	containerIpv4 := container.NetworkSettings.IPAddress + "/32"
+
+	dispatch := ActiveIptablesRule{Chain: EGRESS_CHAIN, JumpTo: egressChain(container.ID), Origin: EGRESS_ORIGIN}
+	dispatch.Source, dispatch.SourceAlias = containerIpv4, "."
+
+	rules := []*ActiveIptablesRule{&dispatch}
+	if policy == EGRESS_POLICY_DENY {
+		drop := ActiveIptablesRule{Chain: egressChain(container.ID), JumpTo: "DROP", Origin: EGRESS_ORIGIN}
+		drop.Source, drop.SourceAlias = containerIpv4, "."
+
+		rules = append(rules, &drop)
+	}
+	return rules
+}
+
+// create the container egress chain and apply the egress policy rules, updating the collection
+func (c *IptablesRulesCollection) applyEgressPolicy(container *docker.Container, policy string) error {
+	exists, err := chainExists(EGRESS_CHAIN)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New(fmt.Sprintf("chain %s not found, run 'init --egress' first", EGRESS_CHAIN))
+	}
+
+	_, err = ensureChain(egressChain(container.ID), false)
+	if err != nil {
+		return err
+	}
+
+	desired := egressPolicyRules(container, policy)
+
+	kept := []*ActiveIptablesRule{}
+	for _, r := range c.Rules {
+		if r.Origin != EGRESS_ORIGIN {
+			kept = append(kept, r)
+			continue
+		}
+
+		wanted := false
+		for _, d := range desired {
+			if d.Format() == r.Format() {
+				wanted = true
+				break
+			}
+		}
+		if !wanted {
+			// attempt to delete, do not make a permanent failure
+			_ = internalDelete(r.Format(), true)
+			continue
+		}
+		kept = append(kept, r)
+	}
+	c.Rules = kept
+
+	for _, d := range desired {
+		// appended, so that the terminal drop follows all whitelisted flows
+		err := internalAppend(container.Name[1:], d.Format())
+		if err != nil {
+			return err
+		}
+
+		known := false
+		for _, r := range c.Rules {
+			if r.Format() == d.Format() {
+				known = true
+				break
+			}
+		}
+		if !known {
+			c.Append(d)
+		}
+	}
+
+	c.EgressPolicy = policy
+	return nil
+}
+
+// corresponding to a subcommand ('egress-policy')
+func SetEgressPolicy(cid, policy string) error {
+	if policy != EGRESS_POLICY_ALLOW && policy != EGRESS_POLICY_DENY {
+		return errors.New("not a valid egress policy: " + policy)
+	}
+
+	container, err := ccl.LookupOnlineContainer(cid)
+	if err != nil {
+		return err
+	}
+
+	c, err := LoadRules(container)
+	if err != nil {
+		return err
+	}
+
+	err = c.applyEgressPolicy(container, policy)
+	if err != nil {
+		return err
+	}
+
+	return c.Save()
+}
+
+// corresponding to a subcommand ('add-egress')
+func AddEgressRule(cid string, iptRule *IptablesRule, expires *time.Time) error {
+	if iptRule.SourceAlias != "." {
+		return errors.New("source of an egress rule must be the container itself")
+	}
+
+	container, err := ccl.LookupOnlineContainer(cid)
+	if err != nil {
+		return err
+	}
+
+	c, err := LoadRules(container)
+	if err != nil {
+		return err
+	}
+
+	// outbound traffic of the container must be dispatched to its chain
+	if c.EgressPolicy == "" {
+		err = c.applyEgressPolicy(container, EGRESS_POLICY_ALLOW)
+		if err != nil {
+			return err
+		}
+
+		err = c.Save()
+		if err != nil {
+			return err
+		}
+	}
+
+	addedRule := ActiveIptablesRule{Chain: egressChain(container.ID), JumpTo: "ACCEPT", Expires: expires}
+	addedRule.IptablesRule = *iptRule
+
+	err = internalInsert(addedRule.Position(), addedRule.Format())
+	if err != nil {
+		return err
+	}
+
+	return recordRule(container, &addedRule)
+}
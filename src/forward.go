@@ -0,0 +1,123 @@
+/*
+ * docker-fw v0.2.4 - a complementary tool for Docker to manage custom
+ *                    firewall rules between/towards Docker containers
+ * Copyright (C) 2014~2016 gdm85 - https://github.com/gdm85/docker-fw/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const FORWARD_ORIGIN = "forward"
+
+// options of the 'forward' action
+type ForwardOptions struct {
+	HostIp        string // optional, all local addresses when not specified
+	HostPort      uint16
+	ContainerPort uint16
+	Protocol      string
+}
+
+func (opts *ForwardOptions) Validate() error {
+	if opts.HostPort == 0 {
+		return errors.New("--host-port is mandatory")
+	}
+	if opts.ContainerPort == 0 {
+		return errors.New("--container-port is mandatory")
+	}
+	if opts.Protocol != "tcp" && opts.Protocol != "udp" {
+		return errors.New("not a valid protocol: " + opts.Protocol)
+	}
+	if opts.HostIp != "" && (!matchIpv4.MatchString(opts.HostIp) || strings.Contains(opts.HostIp, "/")) {
+		return errors.New("not a valid IPv4 host address: " + opts.HostIp)
+	}
+	return nil
+}
+
+// format the options of a forward DNAT rule in docker-fw style
+func (rule *ActiveIptablesRule) FormatAsForwardOptions() string {
+	s := fmt.Sprintf("--host-port %d --container-port %d", rule.DestinationPort, rule.ToPort)
+	if rule.Destination != "" {
+		s += " --host-ip " + strings.TrimSuffix(rule.Destination, "/32")
+	}
+	if rule.Protocol != "tcp" {
+		s += " --protocol " + rule.Protocol
+	}
+	return s
+}
+
+// rules of a forward: DNAT of traffic from other hosts (PREROUTING) and from the host itself (OUTPUT),
+// together with the filter accept of the translated traffic
+func forwardRules(containerIpv4 string, opts *ForwardOptions) []*ActiveIptablesRule {
+	prerouting := ActiveIptablesRule{Table: "nat", Chain: "PREROUTING", JumpTo: "DNAT", ToAddress: containerIpv4, ToPort: opts.ContainerPort, Origin: FORWARD_ORIGIN}
+	prerouting.Protocol = opts.Protocol
+	prerouting.DestinationPort = opts.HostPort
+
+	output := prerouting
+	output.Chain = "OUTPUT"
+
+	accept := ActiveIptablesRule{Chain: "FORWARD", JumpTo: "ACCEPT", Origin: FORWARD_ORIGIN}
+	accept.Destination, accept.DestinationAlias = containerIpv4+"/32", "."
+	accept.Protocol = opts.Protocol
+	accept.DestinationPort = opts.ContainerPort
+	accept.Filter = "! -i docker0 -o docker0"
+
+	if opts.HostIp != "" {
+		prerouting.Destination = opts.HostIp + "/32"
+		output.Destination = opts.HostIp + "/32"
+		accept.Filter += " -m conntrack --ctorigdst " + opts.HostIp + "/32"
+	} else {
+		// same matches used by Docker for published ports
+		prerouting.Filter = "-m addrtype --dst-type LOCAL"
+		output.Filter = "! -d 127.0.0.0/8 -m addrtype --dst-type LOCAL"
+	}
+	accept.Filter += fmt.Sprintf(" -m conntrack --ctorigdstport %d", opts.HostPort)
+
+	return []*ActiveIptablesRule{&prerouting, &output, &accept}
+}
+
+// corresponding to a subcommand ('forward')
+// forward an additional host port to a running container, without re-creating it
+func AddForward(cid string, opts *ForwardOptions) error {
+	err := opts.Validate()
+	if err != nil {
+		return err
+	}
+
+	container, err := ccl.LookupOnlineContainer(cid)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range forwardRules(container.NetworkSettings.IPAddress, opts) {
+		err := internalInsert(r.Position(), r.Format())
+		if err != nil {
+			return err
+		}
+
+		err = recordRule(container, r)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
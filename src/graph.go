@@ -20,19 +20,56 @@ Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
 package main
 
 import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
 	"github.com/fsouza/go-dockerclient"
 )
 
+// kinds of dependency between containers
+const (
+	EDGE_LINK         = "link"
+	EDGE_VOLUMES_FROM = "volumes-from"
+	EDGE_NETWORK      = "network"
+	EDGE_COMPOSE      = "depends_on"
+	EDGE_LABEL        = "label"
+)
+
+// used in error messages about a dependency missing from selection
+var edgeDescriptions = map[string]string{
+	EDGE_LINK:         "",
+	EDGE_VOLUMES_FROM: " (volumes provider)",
+	EDGE_NETWORK:      " (network provider)",
+	EDGE_COMPOSE:      " (compose dependency)",
+	EDGE_LABEL:        " (label dependency)",
+}
+
 type Node struct {
 	ingress int
 
 	ID       string            // same as Container.ID
 	Name     string            // used for debugging/dry-run purposes
+	Priority int               // higher priority nodes go first among the ones that do not depend on each other
 	children SortableNodeArray // all direct one-way links (slice of container names)
+	kinds    []string          // kind of dependency of each of the children
 }
 
 type SortableNodeArray []*Node
 
+// order by priority (highest first), then by name
+func (arr SortableNodeArray) Len() int      { return len(arr) }
+func (arr SortableNodeArray) Swap(i, j int) { arr[i], arr[j] = arr[j], arr[i] }
+func (arr SortableNodeArray) Less(i, j int) bool {
+	if arr[i].Priority != arr[j].Priority {
+		return arr[i].Priority > arr[j].Priority
+	}
+	return arr[i].Name < arr[j].Name
+}
+
 func NewNode(container *docker.Container) *Node {
 	return &Node{
 		ID:       container.ID,
@@ -41,11 +78,31 @@ func NewNode(container *docker.Container) *Node {
 	}
 }
 
-func (node *Node) LinkTo(child *Node) {
+func (node *Node) LinkTo(child *Node, kind string) {
 	node.children = append(node.children, child)
+	node.kinds = append(node.kinds, kind)
 	child.ingress++
 }
 
+// a dependency cycle, e.g. 'a' depends on 'b' which depends on 'a'
+type CycleError struct {
+	Path  []string // names of containers, first and last are the same
+	Kinds []string // kind of each dependency in path
+}
+
+func (e *CycleError) Error() string {
+	return "found dependency cycle: " + e.Format()
+}
+
+// format as 'a -> b (link) -> c (volumes-from) -> a (label)', where each container depends on the next one
+func (e *CycleError) Format() string {
+	s := e.Path[0]
+	for i, kind := range e.Kinds {
+		s += fmt.Sprintf(" -> %s (%s)", e.Path[i+1], kind)
+	}
+	return s
+}
+
 ///
 /// 'a' node is 'less' than 'b' node if and only if:
 ///  - 'a' links to 'b'
@@ -55,9 +112,25 @@ func (node *Node) LinkTo(child *Node) {
 /// nodes that have no incoming links (or already started nodes) have priority and go on top of the list
 /// based on code by bjarneh - https://github.com/bjarneh/godag/blob/master/src/cmplr/dag.go
 ///
-func (arr SortableNodeArray) TopSort() SortableNodeArray {
-	zero := SortableNodeArray{}
+func (arr SortableNodeArray) TopSort() (SortableNodeArray, error) {
+	levels, err := arr.TopSortLevels()
+	if err != nil {
+		return nil, err
+	}
+
 	sorted := SortableNodeArray{}
+	for _, level := range levels {
+		sorted = append(sorted, level...)
+	}
+	return sorted, nil
+}
+
+// same as TopSort, but nodes are grouped in levels: nodes of a level depend only on nodes of previous levels,
+// thus all nodes of a level can be started at the same time
+func (arr SortableNodeArray) TopSortLevels() ([]SortableNodeArray, error) {
+	levels := []SortableNodeArray{}
+	zero := SortableNodeArray{}
+	count := 0
 
 	for _, v := range arr {
 		if v.ingress == 0 {
@@ -66,22 +139,331 @@ func (arr SortableNodeArray) TopSort() SortableNodeArray {
 	}
 
 	for len(zero) > 0 {
+		// stable order within the level, regardless of the order of links
+		sort.Sort(zero)
+		levels = append(levels, zero)
+		count += len(zero)
+
+		next := SortableNodeArray{}
+		for _, node := range zero {
+			for _, child := range node.children {
+				child.ingress--
+				if child.ingress == 0 {
+					next = append(next, child)
+				}
+			}
+		}
+		zero = next
+	}
+
+	if count < len(arr) {
+		return nil, arr.findCycle()
+	}
+
+	return levels, nil
+}
+
+// to be called after an incomplete TopSort: all nodes left with incoming links are either part of a cycle
+// or depend on one, thus by following their dependencies a cycle is always found
+func (arr SortableNodeArray) findCycle() *CycleError {
+	type parent struct {
+		node *Node
+		kind string
+	}
+
+	parents := map[*Node][]parent{}
+	var start *Node
+	for _, node := range arr {
+		if node.ingress == 0 {
+			continue
+		}
+		if start == nil {
+			start = node
+		}
+		for i, child := range node.children {
+			if child.ingress != 0 {
+				parents[child] = append(parents[child], parent{node, node.kinds[i]})
+			}
+		}
+	}
+
+	path := []*Node{start}
+	kinds := []string{}
+	visited := map[*Node]int{start: 0}
+	for {
+		next := parents[path[len(path)-1]][0]
+		kinds = append(kinds, next.kind)
+
+		if i, ok := visited[next.node]; ok {
+			// cycle closed, discard the nodes that only lead to it
+			cycle := &CycleError{Kinds: kinds[i:]}
+			for _, node := range path[i:] {
+				cycle.Path = append(cycle.Path, node.Name)
+			}
+			cycle.Path = append(cycle.Path, next.node.Name)
+			return cycle
+		}
+
+		visited[next.node] = len(path)
+		path = append(path, next.node)
+	}
+}
+
+// priority of container as declared in the priority label, 0 if not specified
+func containerPriority(container *docker.Container) (int, error) {
+	if container.Config == nil {
+		return 0, nil
+	}
+	value, ok := container.Config.Labels[LABEL_PRIORITY]
+	if !ok {
+		return 0, nil
+	}
+
+	priority, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("label %s of container '%s': not a valid integer '%s'", LABEL_PRIORITY, container.Name[1:], value))
+	}
+	return priority, nil
+}
+
+// a dependency of container that cannot be resolved (e.g. a removed container) is an error,
+// unless skipped with a warning
+func unresolvedDependency(container *docker.Container, err error, skipUnresolved bool) error {
+	if !skipUnresolved {
+		return err
+	}
+	log.Printf("WARNING: skipping a dependency of container '%s': %s", container.Name[1:], err)
+	return nil
+}
+
+// containers that container depends on, as declared (comma-separated names or ids) in the depends-on label;
+// useful for dependencies that Docker does not know about, e.g. a database accessed through its published port
+func labelDependencies(container *docker.Container, skipUnresolved bool) ([]*docker.Container, error) {
+	if container.Config == nil {
+		return nil, nil
+	}
+
+	dependencies := []*docker.Container{}
+	for _, name := range strings.Split(container.Config.Labels[LABEL_DEPENDS_ON], ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		dependency, err := ccl.LookupContainer(name)
+		if err != nil {
+			err = unresolvedDependency(container, errors.New(fmt.Sprintf("label %s of container '%s': %s", LABEL_DEPENDS_ON, container.Name[1:], err)), skipUnresolved)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		dependencies = append(dependencies, dependency)
+	}
+	return dependencies, nil
+}
+
+// a container another container depends on
+type dependency struct {
+	container *docker.Container
+	kind      string
+}
+
+// all containers that container depends on: links, volumes providers, network namespace provider ('--net=container:name'),
+// compose 'depends_on' services and the depends-on label
+// dependencies that cannot be resolved are skipped with a warning if skipUnresolved is specified
+func containerDependencies(container *docker.Container, skipUnresolved bool) ([]dependency, error) {
+	dependencies := []dependency{}
+
+	for _, link := range container.HostConfig.Links {
+		parts := strings.SplitN(link, ":", 2)
+
+		// identify the target container
+		linkName := parts[0][1:]
+		linkContainer, err := ccl.LookupContainer(linkName)
+		if err != nil {
+			err = unresolvedDependency(container, err, skipUnresolved)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		dependencies = append(dependencies, dependency{linkContainer, EDGE_LINK})
+	}
+
+	// now also check dependencies created by volumes
+	for _, volumesProvider := range container.HostConfig.VolumesFrom {
+		// identify the provider container
+		volsContainer, err := ccl.LookupContainer(volumesProvider)
+		if err != nil {
+			err = unresolvedDependency(container, err, skipUnresolved)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
 
-		node := zero[0]
-		zero = zero[1:] // Pop
+		dependencies = append(dependencies, dependency{volsContainer, EDGE_VOLUMES_FROM})
+	}
 
-		for _, child := range node.children {
-			child.ingress--
-			if child.ingress == 0 {
-				zero = append(zero, child)
+	// and by sharing the network namespace of another container
+	if strings.HasPrefix(container.HostConfig.NetworkMode, "container:") {
+		netContainer, err := ccl.LookupContainer(container.HostConfig.NetworkMode[len("container:"):])
+		if err == nil {
+			dependencies = append(dependencies, dependency{netContainer, EDGE_NETWORK})
+		} else {
+			err = unresolvedDependency(container, err, skipUnresolved)
+			if err != nil {
+				return nil, err
 			}
 		}
-		sorted = append(sorted, node)
 	}
 
-	if len(sorted) < len(arr) {
-		panic("found cycle in DAG")
+	// services a compose container depends on
+	composeContainers, err := composeDependencies(container, skipUnresolved)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range composeContainers {
+		dependencies = append(dependencies, dependency{c, EDGE_COMPOSE})
+	}
+
+	// explicit dependencies
+	labelContainers, err := labelDependencies(container, skipUnresolved)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range labelContainers {
+		dependencies = append(dependencies, dependency{c, EDGE_LABEL})
+	}
+
+	return dependencies, nil
+}
+
+// how to handle dependencies that are not part of the selection when building a graph
+const (
+	MISSING_DEPS_ERROR = iota
+	MISSING_DEPS_PULL
+	MISSING_DEPS_IGNORE
+)
+
+// build the graph of dependencies between the selected containers; dependencies that are not part of the selection
+// are an error, unless pullDeps is specified, in which case they are added to the graph together with their own dependencies
+// dependencies that cannot be resolved at all are an error, unless skipUnresolved is specified
+func BuildDependencyGraph(containers []*docker.Container, pullDeps, skipUnresolved bool) (SortableNodeArray, error) {
+	if pullDeps {
+		return buildGraph(containers, MISSING_DEPS_PULL, skipUnresolved)
+	}
+	return buildGraph(containers, MISSING_DEPS_ERROR, skipUnresolved)
+}
+
+// build the graph of dependencies among the selected containers only, e.g. to stop them
+func BuildSelectionGraph(containers []*docker.Container, skipUnresolved bool) (SortableNodeArray, error) {
+	return buildGraph(containers, MISSING_DEPS_IGNORE, skipUnresolved)
+}
+
+func buildGraph(containers []*docker.Container, missingDeps int, skipUnresolved bool) (SortableNodeArray, error) {
+	lookup := map[string]*Node{}
+	getNode := func(container *docker.Container) *Node {
+		node, ok := lookup[container.ID]
+		if !ok {
+			node = NewNode(container)
+			lookup[container.ID] = node
+		}
+		return node
+	}
+
+	// containers are visited once; pulled dependencies are appended to the queue
+	queue := append([]*docker.Container{}, containers...)
+	visited := map[string]bool{}
+	for len(queue) > 0 {
+		container := queue[0]
+		queue = queue[1:]
+		if visited[container.ID] {
+			continue
+		}
+		visited[container.ID] = true
+
+		// prepare container node itself
+		node := getNode(container)
+
+		var err error
+		node.Priority, err = containerPriority(container)
+		if err != nil {
+			return nil, err
+		}
+
+		dependencies, err := containerDependencies(container, skipUnresolved)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, d := range dependencies {
+			if !arrayContains(containers, d.container) {
+				switch missingDeps {
+				case MISSING_DEPS_ERROR:
+					// error if a container is missing from selection and no --pull-deps was specified
+					return nil, errors.New(fmt.Sprintf("container '%s'%s is not specified in list and no --pull-deps specified", d.container.Name[1:], edgeDescriptions[d.kind]))
+				case MISSING_DEPS_PULL:
+					queue = append(queue, d.container)
+				case MISSING_DEPS_IGNORE:
+					continue
+				}
+			}
+
+			// now create association
+			getNode(d.container).LinkTo(node, d.kind)
+		}
+	}
+
+	// convert the map to a flat array, sorted to have the same result at each run
+	var allNodes SortableNodeArray
+	for _, v := range lookup {
+		allNodes = append(allNodes, v)
+	}
+	sort.Sort(allNodes)
+	return allNodes, nil
+}
+
+// all containers (also stopped ones) that depend, directly or not, on any of the specified containers
+func dependentContainers(containers []*docker.Container) ([]*docker.Container, error) {
+	err := ccl.LoadAllContainers()
+	if err != nil {
+		return nil, err
+	}
+	all := ccl.GetAllContainers()
+
+	// dependencies of each container, since they are checked again until no more dependents are found
+	allDependencies := map[string][]dependency{}
+	for _, container := range all {
+		// dependencies that cannot be resolved, e.g. of a stopped container linking to a removed one, are skipped
+		dependencies, err := containerDependencies(container, true)
+		if err != nil {
+			return nil, err
+		}
+		allDependencies[container.ID] = dependencies
+	}
+
+	selected := append([]*docker.Container{}, containers...)
+	dependents := []*docker.Container{}
+	for found := true; found; {
+		found = false
+		for _, container := range all {
+			if arrayContains(selected, container) {
+				continue
+			}
+
+			for _, d := range allDependencies[container.ID] {
+				if arrayContains(selected, d.container) {
+					selected = append(selected, container)
+					dependents = append(dependents, container)
+					found = true
+					break
+				}
+			}
+		}
 	}
 
-	return sorted
+	return dependents, nil
 }
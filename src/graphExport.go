@@ -0,0 +1,180 @@
+/*
+ * docker-fw v0.2.4 - a complementary tool for Docker to manage custom
+ *                    firewall rules between/towards Docker containers
+ * Copyright (C) 2014~2016 gdm85 - https://github.com/gdm85/docker-fw/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	CONTAINER_RUNNING = "running"
+	CONTAINER_PAUSED  = "paused"
+	CONTAINER_STOPPED = "stopped"
+)
+
+// colors used for each container state in dot format
+var dotStateColors = map[string]string{
+	CONTAINER_RUNNING: "darkgreen",
+	CONTAINER_PAUSED:  "orange",
+	CONTAINER_STOPPED: "gray",
+}
+
+type exportedNode struct {
+	Id       string
+	Name     string
+	State    string
+	Priority int
+}
+
+// 'From' container depends on 'To' container
+type exportedEdge struct {
+	From string
+	To   string
+	Kind string
+}
+
+type exportedGraph struct {
+	Nodes []*exportedNode
+	Edges []*exportedEdge
+}
+
+func containerState(container *docker.Container) string {
+	if container.State.Paused {
+		return CONTAINER_PAUSED
+	}
+	if container.State.Running {
+		return CONTAINER_RUNNING
+	}
+	return CONTAINER_STOPPED
+}
+
+type byEdge []*exportedEdge
+
+func (a byEdge) Len() int      { return len(a) }
+func (a byEdge) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byEdge) Less(i, j int) bool {
+	if a[i].From != a[j].From {
+		return a[i].From < a[j].From
+	}
+	if a[i].To != a[j].To {
+		return a[i].To < a[j].To
+	}
+	return a[i].Kind < a[j].Kind
+}
+
+// graph of the specified containers and their dependencies, or of all containers if none specified
+func exportGraph(containerIds []string) (*exportedGraph, error) {
+	var allNodes SortableNodeArray
+	if len(containerIds) == 0 {
+		err := ccl.LoadAllContainers()
+		if err != nil {
+			return nil, err
+		}
+		containers := ccl.GetAllContainers()
+		sort.Sort(byName(containers))
+
+		allNodes, err = BuildSelectionGraph(containers, true)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		containers := []*docker.Container{}
+		for _, cid := range containerIds {
+			container, err := ccl.LookupContainer(cid)
+			if err != nil {
+				return nil, err
+			}
+			containers = append(containers, container)
+		}
+
+		var err error
+		allNodes, err = BuildDependencyGraph(containers, true, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	graph := exportedGraph{Nodes: []*exportedNode{}, Edges: []*exportedEdge{}}
+	for _, node := range allNodes {
+		container, err := ccl.LookupContainer(node.ID)
+		if err != nil {
+			return nil, err
+		}
+		graph.Nodes = append(graph.Nodes, &exportedNode{Id: node.ID, Name: node.Name, State: containerState(container), Priority: node.Priority})
+
+		for i, child := range node.children {
+			graph.Edges = append(graph.Edges, &exportedEdge{From: child.Name, To: node.Name, Kind: node.kinds[i]})
+		}
+	}
+	sort.Sort(byEdge(graph.Edges))
+
+	return &graph, nil
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+func (graph *exportedGraph) WriteDot(w io.Writer) {
+	fmt.Fprintln(w, "digraph docker_fw {")
+	fmt.Fprintln(w, "\tnode [shape=box];")
+	for _, n := range graph.Nodes {
+		style := ""
+		if n.State != CONTAINER_RUNNING {
+			style = ", style=dashed"
+		}
+		fmt.Fprintf(w, "\t%s [label=%s, color=%s%s];\n", dotQuote(n.Name), dotQuote(n.Name+"\\n"+n.State), dotStateColors[n.State], style)
+	}
+	for _, e := range graph.Edges {
+		fmt.Fprintf(w, "\t%s -> %s [label=%s];\n", dotQuote(e.From), dotQuote(e.To), dotQuote(e.Kind))
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// corresponding to a subcommand ('graph')
+// print the dependency graph in dot (graphviz) or json format
+func PrintGraph(w io.Writer, containerIds []string, format string) error {
+	graph, err := exportGraph(containerIds)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "dot":
+		graph.WriteDot(w)
+	case "json":
+		bytes, err := json.MarshalIndent(graph, "", "\t")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(w, string(bytes))
+	default:
+		return errors.New(fmt.Sprintf("unknown format '%s', must be either dot or json", format))
+	}
+	return nil
+}
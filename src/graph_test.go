@@ -0,0 +1,157 @@
+/*
+ * docker-fw v0.2.4 - a complementary tool for Docker to manage custom
+ *                    firewall rules between/towards Docker containers
+ * Copyright (C) 2014~2016 gdm85 - https://github.com/gdm85/docker-fw/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// a dependency of a synthetic graph: 'from' depends on 'to'
+type testEdge struct {
+	from, to, kind string
+}
+
+func testGraph(names []string, priorities map[string]int, edges []testEdge) SortableNodeArray {
+	nodes := map[string]*Node{}
+	graph := SortableNodeArray{}
+	for _, name := range names {
+		node := &Node{ID: name, Name: name, Priority: priorities[name], children: SortableNodeArray{}}
+		nodes[name] = node
+		graph = append(graph, node)
+	}
+	for _, e := range edges {
+		// dependencies link to their dependents
+		nodes[e.to].LinkTo(nodes[e.from], e.kind)
+	}
+	return graph
+}
+
+func levelNames(levels []SortableNodeArray) [][]string {
+	names := [][]string{}
+	for _, level := range levels {
+		l := []string{}
+		for _, node := range level {
+			l = append(l, node.Name)
+		}
+		names = append(names, l)
+	}
+	return names
+}
+
+func TestTopSortLevelsCycle(t *testing.T) {
+	graph := testGraph([]string{"a", "b", "c"}, nil, []testEdge{
+		{"a", "b", EDGE_LINK},
+		{"b", "c", EDGE_VOLUMES_FROM},
+		{"c", "a", EDGE_LABEL},
+	})
+
+	_, err := graph.TopSortLevels()
+	cycle, ok := err.(*CycleError)
+	if !ok {
+		t.Fatalf("expected a cycle error, got %v", err)
+	}
+	if cycle.Format() != "a -> b (link) -> c (volumes-from) -> a (label)" {
+		t.Errorf("unexpected cycle: %s", cycle.Format())
+	}
+
+	// same text as the example in README, reported by the 'start' action
+	readme, err := ioutil.ReadFile("../README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(readme), "\tstart: "+cycle.Error()+"\n") {
+		t.Errorf("cycle error not documented in README: %s", cycle.Error())
+	}
+}
+
+func TestTopSortLevelsCycleWithDependents(t *testing.T) {
+	// 'web' only depends on the cycle, which must be reported without it
+	graph := testGraph([]string{"web", "a", "b"}, nil, []testEdge{
+		{"web", "a", EDGE_COMPOSE},
+		{"a", "b", EDGE_NETWORK},
+		{"b", "a", EDGE_LINK},
+	})
+
+	_, err := graph.TopSortLevels()
+	cycle, ok := err.(*CycleError)
+	if !ok {
+		t.Fatalf("expected a cycle error, got %v", err)
+	}
+	if cycle.Format() != "a -> b (network) -> a (link)" {
+		t.Errorf("unexpected cycle: %s", cycle.Format())
+	}
+}
+
+func TestTopSortLevelsOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		names      []string
+		priorities map[string]int
+		edges      []testEdge
+		expected   [][]string
+	}{
+		{
+			name:     "by name",
+			names:    []string{"web", "cache", "db"},
+			expected: [][]string{{"cache", "db", "web"}},
+		},
+		{
+			name:       "by priority, then by name",
+			names:      []string{"web", "cache", "db", "api"},
+			priorities: map[string]int{"db": 10, "cache": 10, "api": -1},
+			expected:   [][]string{{"cache", "db", "web", "api"}},
+		},
+		{
+			name:       "priority within each level",
+			names:      []string{"worker", "web", "queue", "db"},
+			priorities: map[string]int{"worker": 5},
+			edges: []testEdge{
+				{"web", "db", EDGE_LINK},
+				{"worker", "queue", EDGE_LABEL},
+				{"worker", "db", EDGE_LINK},
+			},
+			expected: [][]string{{"db", "queue"}, {"worker", "web"}},
+		},
+	}
+
+	for _, test := range tests {
+		// the order of input nodes must not matter
+		for _, reversed := range []bool{false, true} {
+			names := append([]string{}, test.names...)
+			if reversed {
+				for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+					names[i], names[j] = names[j], names[i]
+				}
+			}
+
+			levels, err := testGraph(names, test.priorities, test.edges).TopSortLevels()
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			if got := levelNames(levels); !reflect.DeepEqual(got, test.expected) {
+				t.Errorf("%s (reversed: %v): expected %v, got %v", test.name, reversed, test.expected, got)
+			}
+		}
+	}
+}
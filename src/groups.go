@@ -0,0 +1,281 @@
+/*
+ * docker-fw v0.2.4 - a complementary tool for Docker to manage custom
+ *                    firewall rules between/towards Docker containers
+ * Copyright (C) 2014~2016 gdm85 - https://github.com/gdm85/docker-fw/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	GROUP_ALIAS_PREFIX = "@"
+	GROUPS_FILE        = "/var/lib/docker/docker-fw-groups.json"
+)
+
+var groupNameMatch = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// named lists of IPv4 addresses/subnets, referenced as '@name' in address specifications
+type AddressGroups map[string][]string
+
+func LoadAddressGroups() (AddressGroups, error) {
+	groups := AddressGroups{}
+
+	_, err := os.Stat(GROUPS_FILE)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		// file does not exist, no problem
+		return groups, nil
+	}
+
+	// read only when existing
+	bytes, err := ioutil.ReadFile(GROUPS_FILE)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(bytes, &groups)
+	if err != nil {
+		log.Printf("Could not unmarshal address groups '%s'", string(bytes))
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (groups AddressGroups) Save() error {
+	bytes, err := json.Marshal(&groups)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(GROUPS_FILE, bytes, 0666)
+	return err
+}
+
+// resolve a '@name' alias to the group members
+func resolveGroup(alias string) ([]string, error) {
+	groups, err := LoadAddressGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	name := alias[len(GROUP_ALIAS_PREFIX):]
+	members, ok := groups[name]
+	if !ok {
+		return nil, errors.New("address group not found: " + name)
+	}
+	if len(members) == 0 {
+		return nil, errors.New("address group is empty: " + name)
+	}
+
+	return members, nil
+}
+
+// normalize an address to its network address, with '/32' for single addresses
+func normalizeNetworkAddress(address string) (string, error) {
+	if !matchIpv4.MatchString(address) {
+		return "", errors.New("not a valid IPv4 address or subnet: " + address)
+	}
+	if !strings.Contains(address, "/") {
+		address += "/32"
+	}
+
+	_, network, err := net.ParseCIDR(address)
+	if err != nil {
+		return "", err
+	}
+	return network.String(), nil
+}
+
+// corresponding to a subcommand ('group set')
+func SetAddressGroup(name string, addresses []string) error {
+	if !groupNameMatch.MatchString(name) {
+		return errors.New("not a valid group name: " + name)
+	}
+
+	members := []string{}
+	for _, address := range addresses {
+		member, err := normalizeNetworkAddress(address)
+		if err != nil {
+			return err
+		}
+		if !inArray(members, member) {
+			members = append(members, member)
+		}
+	}
+	sort.Strings(members)
+
+	groups, err := LoadAddressGroups()
+	if err != nil {
+		return err
+	}
+
+	groups[name] = members
+
+	return groups.Save()
+}
+
+// corresponding to a subcommand ('group rm')
+// a group still referenced by rules or allow lists of any container is removed only when forced,
+// in which case those rules and allowed addresses are dropped first
+func RemoveAddressGroup(name string, force bool) error {
+	groups, err := LoadAddressGroups()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := groups[name]; !ok {
+		return errors.New("address group not found: " + name)
+	}
+
+	err = ccl.LoadAllContainers()
+	if err != nil {
+		return err
+	}
+
+	alias := GROUP_ALIAS_PREFIX + name
+	users := []string{}
+	for _, container := range ccl.GetAllContainers() {
+		c, err := LoadRules(container)
+		if err != nil {
+			return err
+		}
+
+		if !c.referencesAlias(alias) {
+			continue
+		}
+		if !force {
+			users = append(users, container.Name[1:])
+			continue
+		}
+
+		err = c.dropAlias(container, alias)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(users) != 0 {
+		return errors.New(fmt.Sprintf("address group '%s' is still used by containers %s, use --force to also remove their rules", name, strings.Join(users, ", ")))
+	}
+
+	delete(groups, name)
+
+	return groups.Save()
+}
+
+// true if any rule or allowed address of the collection references alias
+func (c *IptablesRulesCollection) referencesAlias(alias string) bool {
+	for _, r := range c.Rules {
+		if r.SourceAlias == alias || r.DestinationAlias == alias {
+			return true
+		}
+	}
+	for _, l := range c.AllowLists {
+		if l.Find(alias) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// delete from iptables and from the collection all rules and allowed addresses referencing alias
+// container does not need to be running
+func (c *IptablesRulesCollection) dropAlias(container *docker.Container, alias string) error {
+	kept := []*ActiveIptablesRule{}
+	for _, r := range c.Rules {
+		if r.SourceAlias != alias && r.DestinationAlias != alias {
+			kept = append(kept, r)
+			continue
+		}
+
+		// attempt to delete, rule might be missing e.g. because container is not running
+		_ = internalDelete(r.Format(), true)
+		fmt.Printf("docker-fw: iptables(%s): deleted rule '%s'\n", container.Name[1:], r.Format())
+	}
+	c.Rules = kept
+
+	for _, l := range c.AllowLists {
+		if l.Find(alias) == nil {
+			continue
+		}
+
+		addresses := []*AllowedAddress{}
+		for _, a := range l.Addresses {
+			if a.Address != alias {
+				addresses = append(addresses, a)
+			}
+		}
+		l.Addresses = addresses
+		fmt.Printf("docker-fw: allow(%s): revoked '%s'\n", container.Name[1:], alias)
+
+		if l.IpSet != "" && len(l.Addresses) != 0 {
+			_, err := l.SyncIpSet(false)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err := c.forgetEmptyAllowLists()
+	if err != nil {
+		return err
+	}
+
+	return c.Save()
+}
+
+// corresponding to a subcommand ('group ls')
+// display groups as ready-to-use 'group set' actions
+func ListAddressGroups(names []string) error {
+	groups, err := LoadAddressGroups()
+	if err != nil {
+		return err
+	}
+
+	if len(names) == 0 {
+		for name := range groups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	for _, name := range names {
+		members, ok := groups[name]
+		if !ok {
+			return errors.New("address group not found: " + name)
+		}
+		fmt.Printf("group set %s %s\n", name, strings.Join(members, " "))
+	}
+
+	return nil
+}
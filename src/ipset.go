@@ -0,0 +1,199 @@
+/*
+ * docker-fw v0.2.4 - a complementary tool for Docker to manage custom
+ *                    firewall rules between/towards Docker containers
+ * Copyright (C) 2014~2016 gdm85 - https://github.com/gdm85/docker-fw/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	IPSET_BINARY = "ipset"
+	IPSET_PREFIX = "docker-fw-"
+)
+
+func ipsetRun(commandLine string) (int, string, string, error) {
+	return externalRun(IPSET_BINARY, commandLine, false)
+}
+
+// run an ipset command that must succeed
+func ipsetMustRun(commandLine string) error {
+	exitCode, stdo, stde, err := ipsetRun(commandLine)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		fmt.Fprintln(os.Stdout, stdo)
+		fmt.Fprintln(os.Stderr, stde)
+		return errors.New(fmt.Sprintf("ipset: cannot run '%s'", commandLine))
+	}
+	return nil
+}
+
+// normalize an address for comparison with ipset output, which omits the '/32' suffix
+func ipsetMember(address string) string {
+	return strings.TrimSuffix(address, "/32")
+}
+
+func ipsetExists(name string) (bool, error) {
+	exitCode, _, _, err := ipsetRun("-q list -n " + name)
+	if err != nil {
+		return false, err
+	}
+	return exitCode == 0, nil
+}
+
+// create the ipset if it does not exist; entries support an optional timeout
+func ipsetCreate(name string) error {
+	return ipsetMustRun(fmt.Sprintf("-exist create %s hash:net timeout 0", name))
+}
+
+func ipsetAdd(name, member string, expires *time.Time) error {
+	timeout := ""
+	if expires != nil {
+		seconds := int(expires.Sub(time.Now()).Seconds())
+		if seconds <= 0 {
+			// already expired, nothing to add
+			return nil
+		}
+		timeout = fmt.Sprintf(" timeout %d", seconds)
+	}
+	return ipsetMustRun(fmt.Sprintf("-exist add %s %s%s", name, member, timeout))
+}
+
+func ipsetDel(name, address string) error {
+	return ipsetMustRun(fmt.Sprintf("-exist del %s %s", name, address))
+}
+
+// list current members of an ipset
+func ipsetMembers(name string) ([]string, error) {
+	exitCode, stdo, stde, err := ipsetRun("save " + name)
+	if err != nil {
+		return nil, err
+	}
+	if exitCode != 0 {
+		fmt.Fprintln(os.Stderr, stde)
+		return nil, errors.New("ipset: cannot list members of " + name)
+	}
+
+	members := []string{}
+	prefix := "add " + name + " "
+	for _, line := range strings.Split(stdo, "\n") {
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		fields := strings.Fields(line[len(prefix):])
+		if len(fields) > 0 {
+			members = append(members, fields[0])
+		}
+	}
+	return members, nil
+}
+
+// update in place the ipset members so that they match the allow list
+// returns true if there was any change
+func (l *AllowList) SyncIpSet(dryRun bool) (bool, error) {
+	exists, err := ipsetExists(l.IpSet)
+	if err != nil {
+		return false, err
+	}
+
+	current := []string{}
+	if exists {
+		current, err = ipsetMembers(l.IpSet)
+		if err != nil {
+			return false, err
+		}
+	} else {
+		if dryRun {
+			fmt.Printf("docker-fw: ipset(%s): would create set\n", l.IpSet)
+		} else {
+			err := ipsetCreate(l.IpSet)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	changed := !exists
+	desired := []string{}
+	for _, a := range l.ActiveAddresses() {
+		// groups and hostnames are expanded to their current addresses
+		addresses, _, err := parseExternalAddress(a.Address)
+		if err != nil {
+			return false, err
+		}
+
+		for _, address := range addresses {
+			member := ipsetMember(address)
+			if inArray(desired, member) {
+				continue
+			}
+			desired = append(desired, member)
+
+			// entries are always updated, so that their timeout follows the address expiry
+			if !inArray(current, member) {
+				changed = true
+				if dryRun {
+					fmt.Printf("docker-fw: ipset(%s): would add '%s'\n", l.IpSet, address)
+					continue
+				}
+			} else if dryRun {
+				continue
+			}
+			err := ipsetAdd(l.IpSet, address, a.Expires)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+
+	for _, member := range current {
+		if inArray(desired, member) {
+			continue
+		}
+
+		changed = true
+		if dryRun {
+			fmt.Printf("docker-fw: ipset(%s): would delete '%s'\n", l.IpSet, member)
+			continue
+		}
+		err := ipsetDel(l.IpSet, member)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return changed, nil
+}
+
+// destroy all ipsets of a collection, used when dropping its rules
+func (c *IptablesRulesCollection) DestroyIpSets() {
+	for _, l := range c.AllowLists {
+		if l.IpSet != "" {
+			// attempt to destroy, do not make a permanent failure
+			_, _, _, _ = ipsetRun("destroy " + l.IpSet)
+		}
+	}
+}
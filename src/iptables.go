@@ -25,11 +25,14 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
 	"os/exec"
 	"regexp"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 )
@@ -43,6 +46,7 @@ const (
 type IptablesRule struct {
 	Source           string
 	SourceAlias      string // optional
+	SourceSet        string `json:",omitempty"` // optional, ipset matched instead of source address
 	SourcePort       uint16 // optional
 	Destination      string
 	DestinationAlias string // optional
@@ -53,13 +57,21 @@ type IptablesRule struct {
 
 type ActiveIptablesRule struct {
 	IptablesRule
-	Chain  string
-	JumpTo string
+	Table     string `json:",omitempty"` // optional, 'filter' when not specified
+	Chain     string
+	JumpTo    string
+	ToAddress string     `json:",omitempty"` // optional, container address for DNAT target
+	ToPort    uint16     `json:",omitempty"` // optional, container port for DNAT target
+	Expires   *time.Time `json:",omitempty"` // optional, rule is removed by 'expire' action afterwards
+	Origin    string     `json:",omitempty"` // optional, action that generated the rule (when not an add action)
+	Label     string     `json:",omitempty"` // optional, container label that declared the rule
 }
 
 type IptablesRulesCollection struct {
-	cid   string
-	Rules []*ActiveIptablesRule
+	cid          string
+	Rules        []*ActiveIptablesRule
+	AllowLists   []*AllowList `json:",omitempty"`
+	EgressPolicy string       `json:",omitempty"` // optional, set by 'egress-policy' or first 'add-egress' action
 }
 
 var (
@@ -72,40 +84,71 @@ func (r *ActiveIptablesRule) Position() int {
 		return 2
 	} else if r.Chain == "INPUT" {
 		return 1
+	} else if isEgressChain(r.Chain) {
+		// the terminal drop, if any, is always at the bottom
+		return 1
+	} else if r.Table == "nat" && (r.Chain == "PREROUTING" || r.Chain == "OUTPUT") {
+		// before the jump to Docker's own DNAT rules
+		return 1
 	} else {
 		panic("Cannot determine position for chain " + r.Chain)
 	}
 }
 
-func init() {
-	// test that iptables works
-	exitCode, stdo, stde, err := iptablesRun("--version", true)
-	if err != nil {
-		panic(fmt.Sprintf("iptables: %s", err))
-	}
-	if exitCode != 0 {
-		fmt.Fprintln(os.Stdout, stdo)
-		fmt.Fprintln(os.Stderr, stde)
-		panic("iptables: not available")
-	}
+// rules that must be appended to their chain rather than inserted on top
+func (r *ActiveIptablesRule) Appended() bool {
+	return r.Chain == DOCKER_CHAIN || r.Origin == EGRESS_ORIGIN
+}
 
+func init() {
+	var err error
 	matchIpv4, err = regexp.Compile("^((([0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5])\\.){3}([0-9]|[1-9][0-9]|1[0-9]{2}|2[0-4][0-9]|25[0-5]))(/[0-9]{1,2})?$")
 	if err != nil {
 		panic(err)
 	}
 
 	// initialize cache used for all operations
-	ccl = &CachedContainerLookup{containers: map[string]*docker.Container{}, networkAddress: map[string]*docker.Container{}}
+	resetContainerCache()
 }
 
 func isDockerIPv4(ipv4 string) bool {
 	return strings.HasPrefix(ipv4, "172.")
 }
 
+var (
+	iptablesCheck    sync.Once
+	iptablesCheckErr error
+)
+
+// test that iptables works, once before it is used for the first time
+func checkIptables() error {
+	iptablesCheck.Do(func() {
+		exitCode, stdo, stde, err := externalRun(IPTABLES_BINARY, "--version", true)
+		if err != nil {
+			iptablesCheckErr = errors.New(fmt.Sprintf("iptables: %s", err))
+			return
+		}
+		if exitCode != 0 {
+			fmt.Fprintln(os.Stdout, stdo)
+			fmt.Fprintln(os.Stderr, stde)
+			iptablesCheckErr = errors.New("iptables: not available")
+		}
+	})
+	return iptablesCheckErr
+}
+
 func iptablesRun(commandLine string, isCheck bool) (int, string, string, error) {
+	err := checkIptables()
+	if err != nil {
+		return 1, "", "", err
+	}
+	return externalRun(IPTABLES_BINARY, commandLine, isCheck)
+}
+
+func externalRun(binary, commandLine string, isCheck bool) (int, string, string, error) {
 	var err error
 
-	commandLine = IPTABLES_BINARY + " " + commandLine
+	commandLine = binary + " " + commandLine
 	cmd := exec.Command("sh", "-c", commandLine)
 	cmd.Env = os.Environ()
 	cmd.Dir, err = os.Getwd()
@@ -161,121 +204,51 @@ func iptablesRun(commandLine string, isCheck bool) (int, string, string, error)
 	return exitCode, stdo, stde, nil
 }
 
-func InitializeFirewall() error {
-	// check if daemon is running
-	err := Docker.Ping()
-	if err != nil {
-		return err
-	}
-
-	// this Docker-added rule must be disposed, see https://github.com/docker/docker/issues/6034#issuecomment-58742268
-	rule := "FORWARD -o docker0 -j " + DOCKER_CHAIN
-	exists, err := RuleExists(rule)
-	if err != nil {
-		return err
-	}
-	if exists {
-		err := internalDelete(rule, false)
-		if err != nil {
-			return err
-		}
-
-		// insert new rule for internal docker traffic on top
-		err = internalInsert(1, "FORWARD -i docker0 -o docker0 -j DOCKER")
-		if err != nil {
-			return err
-		}
-	} else {
-		return errors.New("Could not find docker-added rule")
-	}
-
-	//TODO: check that our inserted rule is still on top
-	// possibly extend this check everywhere iptables is touched
-
-	return nil
-}
-
-func NewIptablesRule(cid string, source string, sourcePort uint16, dest string, destPort uint16, proto, filter string, reverseLookupContainerIPv4 bool) (*IptablesRule, error) {
+// create the rules for specified flow; more than one rule is returned when
+// source or destination resolve to multiple addresses (e.g. 'dns:' aliases)
+func NewIptablesRule(cid string, source string, sourcePort uint16, dest string, destPort uint16, proto, filter string, reverseLookupContainerIPv4 bool) ([]*IptablesRule, error) {
 	container, err := ccl.LookupOnlineContainer(cid)
 	if err != nil {
 		return nil, err
 	}
 
-	rule := IptablesRule{}
-
-	rule.Source, rule.SourceAlias, err = ccl.ParseAddress(source, container, reverseLookupContainerIPv4)
+	sources, sourceAlias, err := ccl.ParseAddresses(source, container, reverseLookupContainerIPv4)
 	if err != nil {
 		return nil, err
 	}
 
-	rule.Destination, rule.DestinationAlias, err = ccl.ParseAddress(dest, container, reverseLookupContainerIPv4)
+	destinations, destinationAlias, err := ccl.ParseAddresses(dest, container, reverseLookupContainerIPv4)
 	if err != nil {
 		return nil, err
 	}
 
-	// enforce a valid flow specification
-	if rule.Source == rule.Destination {
-		return nil, errors.New("cannot add rule with same source and destination")
-	}
-
-	if rule.SourceAlias != "." && rule.DestinationAlias != "." {
+	if sourceAlias != "." && destinationAlias != "." {
 		return nil, errors.New("either source or destination must be the container itself")
 	}
 
-	rule.SourcePort = sourcePort
-	rule.DestinationPort = destPort
-	rule.Protocol = proto
-	rule.Filter = filter
-
-	return &rule, nil
-}
-
-// corresponding to a subcommand
-// function to allow incoming traffic for a specific container
-func AllowExternal(cid string, whitelist4 []string) error {
-	container, err := ccl.LookupOnlineContainer(cid)
-	if err != nil {
-		return err
-	}
-
-	containerIpv4 := container.NetworkSettings.IPAddress + "/32"
-
-	for _, port := range container.NetworkSettings.PortMappingAPI() {
-		// skip this port, it has not been published
-		if port.PrivatePort == 0 {
-			continue
-		}
-
-		if port.Type != "tcp" && port.Type != "udp" {
-			return errors.New(fmt.Sprintf("Unrecognized protocol '%s' for port %d of container %s", port.Type, port.PrivatePort, cid))
-		}
-		if port.IP != "0.0.0.0" {
-			return errors.New(fmt.Sprintf("Unrecognized host ip '%s' for binding of port %d (container %s)", port.IP, port.PrivatePort, cid))
-		}
+	rules := []*IptablesRule{}
+	for _, src := range sources {
+		for _, dst := range destinations {
+			rule := IptablesRule{}
 
-		// create a rule for each whitelisted external IPv4
-		for _, wIpv4 := range whitelist4 {
-			wIpv4 = strings.Trim(wIpv4, " ")
+			rule.Source, rule.SourceAlias = src, sourceAlias
+			rule.Destination, rule.DestinationAlias = dst, destinationAlias
 
-			// always make IPv4 specific, unless a subnet is specified
-			if !strings.Contains(wIpv4, "/") {
-				wIpv4 += "/32"
+			// enforce a valid flow specification
+			if rule.Source == rule.Destination {
+				return nil, errors.New("cannot add rule with same source and destination")
 			}
 
-			rule := IptablesRule{
-				Source: wIpv4, Destination: containerIpv4, Protocol: port.Type, DestinationPort: uint16(port.PrivatePort),
-				DestinationAlias: ".",
-				Filter:           "! -i docker0 -o docker0",
-			}
+			rule.SourcePort = sourcePort
+			rule.DestinationPort = destPort
+			rule.Protocol = proto
+			rule.Filter = filter
 
-			err := addFirewallRule(container, &rule)
-			if err != nil {
-				return err
-			}
+			rules = append(rules, &rule)
 		}
 	}
 
-	return nil
+	return rules, nil
 }
 
 // format in docker-fw style
@@ -294,25 +267,50 @@ func (rule *IptablesRule) FormatAsFwAction() string {
 	return s
 }
 
+// source, destination and protocol are omitted when empty (e.g. for the egress policy rules)
 func (rule *IptablesRule) Format() string {
-	s := fmt.Sprintf("-s %s -d %s %s -p %s -m %s", rule.Source, rule.Destination, rule.Filter, rule.Protocol, rule.Protocol)
+	parts := []string{}
+	if rule.SourceSet != "" {
+		parts = append(parts, fmt.Sprintf("-m set --match-set %s src", rule.SourceSet))
+	} else if rule.Source != "" {
+		parts = append(parts, fmt.Sprintf("-s %s", rule.Source))
+	}
+	if rule.Destination != "" {
+		parts = append(parts, fmt.Sprintf("-d %s", rule.Destination))
+	}
+	if rule.Filter != "" {
+		parts = append(parts, rule.Filter)
+	}
+	if rule.Protocol != "" {
+		parts = append(parts, fmt.Sprintf("-p %s -m %s", rule.Protocol, rule.Protocol))
+	}
 	if rule.DestinationPort != 0 {
-		s += fmt.Sprintf(" --dport %d", rule.DestinationPort)
+		parts = append(parts, fmt.Sprintf("--dport %d", rule.DestinationPort))
 	}
 	if rule.SourcePort != 0 {
-		s += fmt.Sprintf(" --sport %d", rule.SourcePort)
+		parts = append(parts, fmt.Sprintf("--sport %d", rule.SourcePort))
 	}
 
-	return s
+	return strings.Join(parts, " ")
 }
 
 func (rule *ActiveIptablesRule) Format() string {
-	return fmt.Sprintf("%s %s -j %s", rule.Chain, rule.IptablesRule.Format(), rule.JumpTo)
+	s := rule.Chain
+	if rule.Table != "" {
+		s += " -t " + rule.Table
+	}
+	s += fmt.Sprintf(" %s -j %s", rule.IptablesRule.Format(), rule.JumpTo)
+	if rule.ToAddress != "" {
+		s += fmt.Sprintf(" --to-destination %s:%d", rule.ToAddress, rule.ToPort)
+	}
+	return s
 }
 
 // guess the action that was used to create this rule
-// NOTE: rules create through 'allow' will not return back an 'allow' action
 func (rule *ActiveIptablesRule) ExtrapolateAction() string {
+	if rule.Origin != "" {
+		return rule.Origin
+	}
 	if rule.Chain == "INPUT" && rule.JumpTo == "ACCEPT" {
 		return "add-input"
 	}
@@ -322,11 +320,80 @@ func (rule *ActiveIptablesRule) ExtrapolateAction() string {
 	if rule.Chain == "FORWARD" && rule.JumpTo == DOCKER_CHAIN {
 		return "add"
 	}
+	if isEgressChain(rule.Chain) && rule.JumpTo == "ACCEPT" {
+		return "add-egress"
+	}
 	panic("not yet implemented: proper de-serialization of rule " + rule.Format())
 }
 
 func (rule *ActiveIptablesRule) FormatAsFwCommand(target string) string {
-	return fmt.Sprintf("%s %s %s", rule.ExtrapolateAction(), target, rule.IptablesRule.FormatAsFwAction())
+	var s string
+	switch action := rule.ExtrapolateAction(); action {
+	case ALLOW_ORIGIN:
+		// members of an ipset are only known to its allow list
+		if rule.SourceSet != "" {
+			s = fmt.Sprintf("%s --ipset %s", action, target)
+		} else {
+			s = fmt.Sprintf("%s %s %s", action, target, rule.SourceAliasOrAddress())
+		}
+	case FORWARD_ORIGIN:
+		s = fmt.Sprintf("%s %s %s", action, target, rule.FormatAsForwardOptions())
+	case EGRESS_ORIGIN:
+		if rule.JumpTo == "DROP" {
+			s = fmt.Sprintf("%s %s %s", action, target, EGRESS_POLICY_DENY)
+		} else {
+			s = fmt.Sprintf("%s %s %s", action, target, EGRESS_POLICY_ALLOW)
+		}
+	default:
+		s = fmt.Sprintf("%s %s %s", action, target, rule.IptablesRule.FormatAsFwAction())
+	}
+	if rule.Expires != nil {
+		s += " " + formatExpiry(*rule.Expires)
+	}
+	return s
+}
+
+// format expiry as the remaining lifetime, or as the expiry time if already in the past
+func formatExpiry(expires time.Time) string {
+	remaining := expires.Sub(time.Now())
+	remaining -= remaining % time.Second
+	if remaining <= 0 {
+		return "--expires " + expires.Format(time.RFC3339)
+	}
+	return fmt.Sprintf("--ttl %s", remaining)
+}
+
+// calculate expiry time from either a time-to-live or a RFC3339 timestamp
+// a nil time is returned when neither is specified
+func parseExpiry(ttl, expires string) (*time.Time, error) {
+	if ttl != "" && expires != "" {
+		return nil, errors.New("cannot specify both a time-to-live and an expiry time")
+	}
+
+	var t time.Time
+	if ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, errors.New("time-to-live must be positive")
+		}
+		t = time.Now().Add(d)
+	} else if expires != "" {
+		var err error
+		t, err = time.Parse(time.RFC3339, expires)
+		if err != nil {
+			return nil, err
+		}
+		if !t.After(time.Now()) {
+			return nil, errors.New("expiry time is in the past")
+		}
+	} else {
+		return nil, nil
+	}
+
+	return &t, nil
 }
 
 func (rule *IptablesRule) SourceAliasOrAddress() string {
@@ -358,17 +425,17 @@ func (rule *IptablesRule) Aliases() string {
 }
 
 // corresponding to a subcommand ('add')
-func AddFirewallRule(cid string, iptRule *IptablesRule) error {
+func AddFirewallRule(cid string, iptRule *IptablesRule, expires *time.Time) error {
 	container, err := ccl.LookupOnlineContainer(cid)
 	if err != nil {
 		return err
 	}
 
-	return addFirewallRule(container, iptRule)
+	return addFirewallRule(container, iptRule, expires)
 }
 
-func addFirewallRule(container *docker.Container, iptRule *IptablesRule) error {
-	addedRule := ActiveIptablesRule{Chain: "FORWARD", JumpTo: DOCKER_CHAIN}
+func addFirewallRule(container *docker.Container, iptRule *IptablesRule, expires *time.Time) error {
+	addedRule := ActiveIptablesRule{Chain: "FORWARD", JumpTo: DOCKER_CHAIN, Expires: expires}
 	addedRule.IptablesRule = *iptRule
 
 	// insert always on top
@@ -382,13 +449,13 @@ func addFirewallRule(container *docker.Container, iptRule *IptablesRule) error {
 }
 
 // corresponding to a subcommand (add-input)
-func AddInputRule(cid string, iptRule *IptablesRule) error {
+func AddInputRule(cid string, iptRule *IptablesRule, expires *time.Time) error {
 	container, err := ccl.LookupOnlineContainer(cid)
 	if err != nil {
 		return err
 	}
 
-	addedRule := ActiveIptablesRule{Chain: "INPUT", JumpTo: "ACCEPT"}
+	addedRule := ActiveIptablesRule{Chain: "INPUT", JumpTo: "ACCEPT", Expires: expires}
 	addedRule.IptablesRule = *iptRule
 
 	err = internalInsert(addedRule.Position(), addedRule.Format())
@@ -400,9 +467,9 @@ func AddInputRule(cid string, iptRule *IptablesRule) error {
 }
 
 // corresponding to action add-two-ways
-func AddTwoWays(cid string, iptRule *IptablesRule) error {
+func AddTwoWays(cid string, iptRule *IptablesRule, expires *time.Time) error {
 	// create or update the two-ways hook for source
-	if iptRule.SourceAlias == "" {
+	if iptRule.SourceAlias == "" || isMultiAddressAlias(iptRule.SourceAlias) {
 		return errors.New("Source must be a container id/name")
 	}
 	err := updateCustomHosts(iptRule.SourceAlias, cid)
@@ -411,7 +478,7 @@ func AddTwoWays(cid string, iptRule *IptablesRule) error {
 	}
 
 	// this is necessary because of --icc=false
-	err = AddInternalRule(cid, iptRule)
+	err = AddInternalRule(cid, iptRule, expires)
 	if err != nil {
 		return err
 	}
@@ -419,13 +486,13 @@ func AddTwoWays(cid string, iptRule *IptablesRule) error {
 }
 
 // corresponding to a subcommand (add-internal)
-func AddInternalRule(cid string, iptRule *IptablesRule) error {
+func AddInternalRule(cid string, iptRule *IptablesRule, expires *time.Time) error {
 	container, err := ccl.LookupOnlineContainer(cid)
 	if err != nil {
 		return err
 	}
 
-	addedRule := ActiveIptablesRule{Chain: DOCKER_CHAIN, JumpTo: "ACCEPT"}
+	addedRule := ActiveIptablesRule{Chain: DOCKER_CHAIN, JumpTo: "ACCEPT", Expires: expires}
 	addedRule.IptablesRule = *iptRule
 
 	err = internalAppend(cid, addedRule.Format())
@@ -441,7 +508,7 @@ func (c *IptablesRulesCollection) Append(iptRule *ActiveIptablesRule) {
 }
 
 func (c *IptablesRulesCollection) fileName() string {
-	return fmt.Sprintf("/var/lib/docker/containers/%s/extraRules.json", c.cid)
+	return fmt.Sprintf("%s/%s/extraRules.json", containersDir, c.cid)
 }
 
 func (c *IptablesRulesCollection) Remove() error {
@@ -470,7 +537,7 @@ func DropRules(containerIds []string) error {
 		}
 
 		//NOTE: will not delete a JSON representing an empty array
-		if len(c.Rules) == 0 {
+		if len(c.Rules) == 0 && len(c.AllowLists) == 0 {
 			return nil
 		}
 
@@ -478,6 +545,10 @@ func DropRules(containerIds []string) error {
 			// attempt to delete, do not make a permanent failure
 			_ = internalDelete(r.Format(), true)
 		}
+		c.DestroyIpSets()
+		if c.EgressPolicy != "" {
+			removeChain(egressChain(container.ID))
+		}
 
 		err = c.Remove()
 		if err != nil {
@@ -497,6 +568,13 @@ func recordRule(container *docker.Container, iptRule *ActiveIptablesRule) error
 	// check if rule is already there
 	for _, r := range c.Rules {
 		if r.Format() == iptRule.Format() && r.Aliases() == iptRule.Aliases() {
+			// already tracked, only update its expiry (if changed)
+			if !sameExpiry(r.Expires, iptRule.Expires) {
+				r.Expires = iptRule.Expires
+				fmt.Printf("docker-fw: rule '%s' already tracked, updated expiry\n", r.Format())
+				return c.Save()
+			}
+
 			// already tracked, skip
 			fmt.Printf("docker-fw: rule '%s' already tracked\n", r.Format())
 			return nil
@@ -509,6 +587,123 @@ func recordRule(container *docker.Container, iptRule *ActiveIptablesRule) error
 	return c.Save()
 }
 
+func sameExpiry(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// corresponding to a subcommand ('expire')
+// remove from iptables and from the JSON descriptors all rules that have expired
+// containers do not need to be running
+func ExpireRules(dryRun bool) (int, error) {
+	err := ccl.LoadAllContainers()
+	if err != nil {
+		return 1, err
+	}
+
+	now := time.Now()
+	hasChanges := false
+	for _, container := range ccl.GetAllContainers() {
+		c, err := LoadRules(container)
+		if err != nil {
+			return 2, err
+		}
+
+		expiredRules, expiredAddresses, expiredLists := c.removeExpired(now)
+		for _, r := range expiredRules {
+			hasChanges = true
+			if dryRun {
+				fmt.Printf("docker-fw: iptables(%s): would delete expired rule '%s'\n", container.Name[1:], r.Format())
+				continue
+			}
+
+			// attempt to delete, rule might be missing e.g. because container is not running
+			_ = internalDelete(r.Format(), true)
+			fmt.Printf("docker-fw: iptables(%s): deleted expired rule '%s'\n", container.Name[1:], r.Format())
+		}
+
+		for _, a := range expiredAddresses {
+			hasChanges = true
+			if dryRun {
+				fmt.Printf("docker-fw: allow(%s): would delete expired '%s'\n", container.Name[1:], a.Address)
+				continue
+			}
+			fmt.Printf("docker-fw: allow(%s): deleted expired '%s'\n", container.Name[1:], a.Address)
+		}
+
+		if dryRun {
+			continue
+		}
+
+		// remove members that are not referenced anymore by other addresses
+		// NOTE: rules of the other allow lists carry the expiry, thus are removed above
+		for _, l := range expiredLists {
+			if l.IpSet != "" && len(l.Addresses) != 0 {
+				_, err := l.SyncIpSet(false)
+				if err != nil {
+					return 4, err
+				}
+			}
+		}
+
+		// an ipset left without members is destroyed together with the rules matching it
+		err = c.forgetEmptyAllowLists()
+		if err != nil {
+			return 4, err
+		}
+
+		if len(expiredRules) != 0 || len(expiredAddresses) != 0 {
+			err := c.Save()
+			if err != nil {
+				return 3, err
+			}
+		}
+	}
+
+	if dryRun && hasChanges {
+		return 1, nil
+	}
+
+	return 0, nil
+}
+
+// remove from the collection rules and allowed addresses that have expired; returned are the expired rules,
+// which must still be deleted from iptables, the expired addresses and the allow lists they were part of
+func (c *IptablesRulesCollection) removeExpired(now time.Time) ([]*ActiveIptablesRule, []*AllowedAddress, []*AllowList) {
+	kept := []*ActiveIptablesRule{}
+	expiredRules := []*ActiveIptablesRule{}
+	for _, r := range c.Rules {
+		if r.Expires == nil || r.Expires.After(now) {
+			kept = append(kept, r)
+			continue
+		}
+		expiredRules = append(expiredRules, r)
+	}
+	c.Rules = kept
+
+	expiredAddresses := []*AllowedAddress{}
+	expiredLists := []*AllowList{}
+	for _, l := range c.AllowLists {
+		keptAddresses := []*AllowedAddress{}
+		for _, a := range l.Addresses {
+			if a.Expires == nil || a.Expires.After(now) {
+				keptAddresses = append(keptAddresses, a)
+				continue
+			}
+			expiredAddresses = append(expiredAddresses, a)
+		}
+
+		if len(keptAddresses) != len(l.Addresses) {
+			l.Addresses = keptAddresses
+			expiredLists = append(expiredLists, l)
+		}
+	}
+
+	return expiredRules, expiredAddresses, expiredLists
+}
+
 func HasAnyRule() (bool, error) {
 	return false, nil
 }
@@ -613,12 +808,78 @@ func ReplayRules(containerIds []string, dryRun bool) (int, error) {
 			return 2, err
 		}
 
-		changed := false
+		// expired rules are not replayed, but removed as 'expire' action does
+		expiredRules, expiredAddresses, _ := c.removeExpired(time.Now())
+
+		// follow changes of the rules declared in container labels
+		staleRules, changed, err := c.reconcileLabels(container)
+		if err != nil {
+			return 3, err
+		}
+		staleRules = append(staleRules, expiredRules...)
+		if len(expiredRules) != 0 || len(expiredAddresses) != 0 {
+			changed = true
+		}
+
+		// resolve again multi-address aliases, adding and removing rules as needed
+		var staleAliasRules []*ActiveIptablesRule
+		var addedAliasRules bool
+		c.Rules, staleAliasRules, addedAliasRules = expandMultiAddressRules(container, c.Rules)
+		staleRules = append(staleRules, staleAliasRules...)
+		if len(staleAliasRules) > 0 || addedAliasRules {
+			changed = true
+		}
+
+		// regenerate rules of allow lists, following changes of the published ports
+		staleAllowRules, allowChanged, err := c.reconcileAllowRules(container)
+		if err != nil {
+			return 3, err
+		}
+		staleRules = append(staleRules, staleAllowRules...)
+		if allowChanged {
+			changed = true
+		}
+
+		// ipsets must exist before any rule referencing them can be checked or added
+		missingSets := map[string]bool{}
+		for _, l := range c.AllowLists {
+			if l.IpSet == "" {
+				continue
+			}
+			if dryRun {
+				exists, err := ipsetExists(l.IpSet)
+				if err != nil {
+					return 8, err
+				}
+				missingSets[l.IpSet] = !exists
+			}
+			setChanged, err := l.SyncIpSet(dryRun)
+			if err != nil {
+				return 8, err
+			}
+			if setChanged {
+				hasChanges = true
+			}
+		}
+
+		// the container egress chain must exist before any of its rules can be checked or added
+		missingChains := map[string]bool{}
+		if c.EgressPolicy != "" {
+			created, err := ensureChain(egressChain(container.ID), dryRun)
+			if err != nil {
+				return 9, err
+			}
+			if created {
+				hasChanges = true
+				missingChains[egressChain(container.ID)] = dryRun
+			}
+		}
+
 		for _, r := range c.Rules {
 			oldRule := r.Format()
 
 			// de-alias source
-			if r.SourceAlias != "" {
+			if r.SourceAlias != "" && !isMultiAddressAlias(r.SourceAlias) {
 				ipv4, _, err := ccl.ParseAddress(r.SourceAlias, container, false)
 				if err != nil {
 					return 3, err
@@ -631,7 +892,7 @@ func ReplayRules(containerIds []string, dryRun bool) (int, error) {
 			}
 
 			// de-alias destination
-			if r.DestinationAlias != "" {
+			if r.DestinationAlias != "" && !isMultiAddressAlias(r.DestinationAlias) {
 				ipv4, _, err := ccl.ParseAddress(r.DestinationAlias, container, false)
 				if err != nil {
 					return 4, err
@@ -643,6 +904,12 @@ func ReplayRules(containerIds []string, dryRun bool) (int, error) {
 				}
 			}
 
+			// DNAT target is always the container itself
+			if r.ToAddress != "" && r.ToAddress != container.NetworkSettings.IPAddress {
+				changed = true
+				r.ToAddress = container.NetworkSettings.IPAddress
+			}
+
 			// create the rule that it is necessary to have
 			rule := r.Format()
 
@@ -664,16 +931,18 @@ func ReplayRules(containerIds []string, dryRun bool) (int, error) {
 			}
 
 			// check if new rule is already there
-
-			exists, err := RuleExists(rule)
-			if err != nil {
-				return 6, err
+			exists := false
+			if (r.SourceSet == "" || !missingSets[r.SourceSet]) && !missingChains[r.Chain] {
+				exists, err = RuleExists(rule)
+				if err != nil {
+					return 6, err
+				}
 			}
-			if exists {
+			if !exists {
 				//fmt.Printf("iptables(%s): rule '%s' does not exist\n", container.Name[1:], rule)
 
 				// insert or append, depending on destination chain
-				if r.Chain == DOCKER_CHAIN {
+				if r.Appended() {
 					if dryRun {
 						fmt.Printf("docker-fw: iptables(%s): would append rule '%s'\n", container.Name, rule)
 						hasChanges = true
@@ -697,6 +966,15 @@ func ReplayRules(containerIds []string, dryRun bool) (int, error) {
 			}
 		}
 
+		// rules whose address is no more resolved by their alias are removed only after new ones are in place
+		for _, r := range staleRules {
+			if dryRun {
+				fmt.Printf("docker-fw: iptables(%s): would delete rule '%s'\n", container.Name[1:], r.Format())
+			} else {
+				_ = internalDelete(r.Format(), true)
+			}
+		}
+
 		// used for dry-run exit code, report non-zero if anything would change
 		if changed {
 			hasChanges = true
@@ -721,6 +999,93 @@ func ReplayRules(containerIds []string, dryRun bool) (int, error) {
 	return 0, nil
 }
 
+// rules with a multi-address alias are generated one for each address; resolve the alias again
+// and return the updated rules, together with the rules whose address is no more resolved
+// the boolean return value is true if any rule was added for a new address
+// if an alias cannot be resolved (e.g. DNS failure), its last resolved rules are kept
+func expandMultiAddressRules(container *docker.Container, rules []*ActiveIptablesRule) ([]*ActiveIptablesRule, []*ActiveIptablesRule, bool) {
+	// group rules that differ only by the address of their multi-address alias
+	groups := map[string][]*ActiveIptablesRule{}
+	keys := []string{}
+	result := []*ActiveIptablesRule{}
+	for _, r := range rules {
+		// rules of allow lists and labels are regenerated separately
+		if r.Origin == ALLOW_ORIGIN || r.Label != "" {
+			result = append(result, r)
+			continue
+		}
+
+		template := *r
+		if isMultiAddressAlias(r.SourceAlias) {
+			template.Source = ""
+		} else if isMultiAddressAlias(r.DestinationAlias) {
+			template.Destination = ""
+		} else {
+			result = append(result, r)
+			continue
+		}
+
+		key := template.Format() + "\n" + template.Aliases()
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], r)
+	}
+
+	stale := []*ActiveIptablesRule{}
+	added := false
+	for _, key := range keys {
+		group := groups[key]
+		first := group[0]
+
+		isSource := isMultiAddressAlias(first.SourceAlias)
+		alias := first.DestinationAlias
+		if isSource {
+			alias = first.SourceAlias
+		}
+
+		addresses, _, err := ccl.ParseAddresses(alias, container, false)
+		if err != nil {
+			log.Printf("WARNING: cannot resolve '%s' for container '%s', keeping its last resolved rules: %s", alias, container.Name[1:], err)
+			result = append(result, group...)
+			continue
+		}
+
+		current := []string{}
+		for _, r := range group {
+			address := r.Destination
+			if isSource {
+				address = r.Source
+			}
+			current = append(current, address)
+
+			if inArray(addresses, address) {
+				result = append(result, r)
+			} else {
+				stale = append(stale, r)
+			}
+		}
+
+		// new addresses get a copy of the rule
+		for _, address := range addresses {
+			if inArray(current, address) {
+				continue
+			}
+
+			r := *first
+			if isSource {
+				r.Source = address
+			} else {
+				r.Destination = address
+			}
+			result = append(result, &r)
+			added = true
+		}
+	}
+
+	return result, stale, added
+}
+
 func ListRules(containerIds []string) error {
 	containers := []*docker.Container{}
 	if len(containerIds) == 0 {
@@ -748,14 +1113,55 @@ func ListRules(containerIds []string) error {
 			return err
 		}
 
-		if len(collection.Rules) == 0 {
-			continue
+		for _, line := range collection.FormatAsFwCommands(container.Name[1:]) {
+			fmt.Printf("%s\n", line)
 		}
+	}
 
-		for _, rule := range collection.Rules {
-			fmt.Printf("%s\n", rule.FormatAsFwCommand(container.Name[1:]))
+	return nil
+}
+
+// format all rules, allow lists and egress policy of the collection as ready-to-use actions
+func (collection *IptablesRulesCollection) FormatAsFwCommands(target string) []string {
+	lines := []string{}
+
+	// rules generated from a multi-address alias have the same representation
+	shown := map[string]bool{}
+	for _, rule := range collection.Rules {
+		// rules generated from allow lists are displayed through their allow list
+		if rule.Origin == ALLOW_ORIGIN || rule.SourceSet != "" {
+			continue
+		}
+		// rules of the egress policy are displayed through the policy itself
+		if rule.Origin == EGRESS_ORIGIN {
+			continue
+		}
+		// a forward is displayed once, through its PREROUTING rule
+		if rule.Origin == FORWARD_ORIGIN && rule.Chain != "PREROUTING" {
+			continue
+		}
+		line := rule.FormatAsFwCommand(target)
+		if rule.Label != "" {
+			// declared in a label, thus commented out
+			line = fmt.Sprintf("# %s: %s", rule.Label, line)
+		} else if rule.Expires != nil && !rule.Expires.After(time.Now()) {
+			// not yet removed by 'expire', thus commented out
+			line = "# expired: " + line
 		}
+		if shown[line] {
+			continue
+		}
+		shown[line] = true
+		lines = append(lines, line)
 	}
 
-	return nil
+	for _, l := range collection.AllowLists {
+		lines = append(lines, l.FormatAsFwCommands(target)...)
+	}
+
+	if collection.EgressPolicy != "" {
+		lines = append(lines, fmt.Sprintf("%s %s %s", EGRESS_ORIGIN, target, collection.EgressPolicy))
+	}
+
+	return lines
 }
@@ -0,0 +1,346 @@
+/*
+ * docker-fw v0.2.4 - a complementary tool for Docker to manage custom
+ *                    firewall rules between/towards Docker containers
+ * Copyright (C) 2014~2016 gdm85 - https://github.com/gdm85/docker-fw/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// state of the fake iptables binary, shared by its invocations through a file
+type fakeIptablesState struct {
+	Chains map[string][]string // rules of each chain, without the '-A chain' prefix
+	Log    []string            // commands that changed any chain, in order
+}
+
+const FAKE_IPTABLES_STATE_ENV = "DOCKER_FW_FAKE_IPTABLES_STATE"
+
+// the test binary is also run as 'iptables', through a symlink placed first in PATH
+func TestMain(m *testing.M) {
+	if filepath.Base(os.Args[0]) == IPTABLES_BINARY {
+		os.Exit(fakeIptables(os.Args[1:]))
+	}
+
+	dir, err := ioutil.TempDir("", "docker-fw-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	executable, err := os.Executable()
+	if err == nil {
+		err = os.Symlink(executable, filepath.Join(dir, IPTABLES_BINARY))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	os.Setenv(FAKE_IPTABLES_STATE_ENV, filepath.Join(dir, "state.json"))
+
+	exitCode := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(exitCode)
+}
+
+func loadFakeIptables() (*fakeIptablesState, error) {
+	state := fakeIptablesState{}
+	bytes, err := ioutil.ReadFile(os.Getenv(FAKE_IPTABLES_STATE_ENV))
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(bytes, &state)
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (state *fakeIptablesState) save() error {
+	bytes, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(os.Getenv(FAKE_IPTABLES_STATE_ENV), bytes, 0600)
+}
+
+// start a test from the specified chains
+func resetFakeIptables(t *testing.T, chains map[string][]string) {
+	state := fakeIptablesState{Chains: chains}
+	err := state.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fakeIptablesLog(t *testing.T) []string {
+	state, err := loadFakeIptables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state.Log
+}
+
+// emulate the subset of iptables used by docker-fw on the filter table
+func fakeIptables(args []string) int {
+	if len(args) > 0 && args[0] == "--wait" {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return 2
+	}
+	if args[0] == "--version" {
+		fmt.Println("iptables v1.4.21")
+		return 0
+	}
+	if args[0] == "-n" {
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		return 2
+	}
+
+	state, err := loadFakeIptables()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	op, chain, spec := args[0], args[1], args[2:]
+	rules, exists := state.Chains[chain]
+	if !exists && op != "-N" {
+		fmt.Fprintf(os.Stderr, "iptables: No chain/target/match by that name.\n")
+		return 1
+	}
+
+	switch op {
+	case "-S":
+		fmt.Printf("-N %s\n", chain)
+		for _, rule := range rules {
+			fmt.Printf("-A %s %s\n", chain, rule)
+		}
+		return 0
+	case "-L":
+		return 0
+	case "-C":
+		if rulePosition(rules, strings.Join(spec, " ")) == 0 {
+			return 1
+		}
+		return 0
+	case "-N":
+		if exists {
+			return 1
+		}
+		state.Chains[chain] = []string{}
+	case "-F":
+		state.Chains[chain] = []string{}
+	case "-X":
+		delete(state.Chains, chain)
+	case "-A":
+		state.Chains[chain] = append(rules, strings.Join(spec, " "))
+	case "-I":
+		pos := 1
+		if len(spec) > 0 {
+			if n, err := strconv.Atoi(spec[0]); err == nil {
+				pos, spec = n, spec[1:]
+			}
+		}
+		if pos > len(rules)+1 {
+			return 1
+		}
+		inserted := append([]string{}, rules[:pos-1]...)
+		inserted = append(inserted, strings.Join(spec, " "))
+		state.Chains[chain] = append(inserted, rules[pos-1:]...)
+	case "-D":
+		pos := rulePosition(rules, strings.Join(spec, " "))
+		if pos == 0 {
+			return 1
+		}
+		state.Chains[chain] = append(rules[:pos-1:pos-1], rules[pos:]...)
+	default:
+		return 2
+	}
+
+	state.Log = append(state.Log, strings.Join(args, " "))
+	err = state.save()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	return 0
+}
+
+// a running container known only to the containers cache, with its state kept in a temporary directory
+func fakeContainer(t *testing.T, name, ipv4 string) *docker.Container {
+	dir, err := ioutil.TempDir("", "docker-fw-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	origDir := containersDir
+	containersDir = dir
+	t.Cleanup(func() {
+		containersDir = origDir
+		os.RemoveAll(dir)
+		resetContainerCache()
+	})
+
+	id := fmt.Sprintf("%064x", len(name))
+	err = os.Mkdir(filepath.Join(dir, id), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	container := &docker.Container{
+		ID:              id,
+		Name:            "/" + name,
+		Config:          &docker.Config{},
+		State:           docker.State{Running: true},
+		NetworkSettings: &docker.NetworkSettings{IPAddress: ipv4},
+	}
+	resetContainerCache()
+	ccl.containers[id] = container
+	ccl.containers[name] = container
+	ccl.networkAddress[ipv4] = container
+	return container
+}
+
+func TestNewIptablesRuleDns(t *testing.T) {
+	fakeLookupHost(t, map[string][]string{"api.example.test": {"198.51.100.1", "198.51.100.2"}})
+	container := fakeContainer(t, "web", "172.17.0.2")
+
+	rules, err := NewIptablesRule(container.ID, ".", 0, "dns:api.example.test", 443, "tcp", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("expected one rule for each answer, got %d", len(rules))
+	}
+	for i, address := range []string{"198.51.100.1/32", "198.51.100.2/32"} {
+		if rules[i].Destination != address || rules[i].DestinationAlias != "dns:api.example.test" {
+			t.Errorf("rule %d: unexpected destination %s (%s)", i, rules[i].Destination, rules[i].DestinationAlias)
+		}
+	}
+}
+
+func TestReplayDnsAddsBeforeDeleting(t *testing.T) {
+	container := fakeContainer(t, "web", "172.17.0.2")
+
+	// rule recorded when the hostname resolved to 198.51.100.1
+	r := ActiveIptablesRule{Chain: "FORWARD", JumpTo: DOCKER_CHAIN}
+	r.Source, r.SourceAlias = "172.17.0.2/32", "."
+	r.Destination, r.DestinationAlias = "198.51.100.1/32", "dns:api.example.test"
+	r.Protocol, r.DestinationPort = "tcp", 443
+	stale := r.Format()
+
+	c := IptablesRulesCollection{cid: container.ID, Rules: []*ActiveIptablesRule{&r}}
+	err := c.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resetFakeIptables(t, map[string][]string{
+		"FORWARD": {LAYOUT_INTERNAL_LINK[len("FORWARD "):], stale[len("FORWARD "):]},
+		"DOCKER":  {},
+	})
+
+	// now it resolves to other addresses
+	fakeLookupHost(t, map[string][]string{"api.example.test": {"198.51.100.2", "198.51.100.3"}})
+
+	exitCode, err := ReplayRules([]string{container.ID}, false)
+	if err != nil || exitCode != 0 {
+		t.Fatalf("replay: exit code %d, error %v", exitCode, err)
+	}
+
+	// new rules must be in place before the stale one is deleted
+	deleted := -1
+	inserted := []int{}
+	for i, command := range fakeIptablesLog(t) {
+		if command == "-D "+stale {
+			deleted = i
+		} else if strings.HasPrefix(command, "-I FORWARD ") {
+			inserted = append(inserted, i)
+		}
+	}
+	if deleted == -1 || len(inserted) != 2 {
+		t.Fatalf("expected 2 insertions and 1 deletion, got %v", fakeIptablesLog(t))
+	}
+	for _, i := range inserted {
+		if i > deleted {
+			t.Errorf("rule inserted after the stale one was deleted: %v", fakeIptablesLog(t))
+		}
+	}
+
+	// and the new rules must be recorded
+	saved, err := LoadRules(container)
+	if err != nil {
+		t.Fatal(err)
+	}
+	destinations := []string{}
+	for _, r := range saved.Rules {
+		destinations = append(destinations, r.Destination)
+	}
+	expected := []string{"198.51.100.2/32", "198.51.100.3/32"}
+	if !reflect.DeepEqual(destinations, expected) {
+		t.Errorf("expected recorded destinations %v, got %v", expected, destinations)
+	}
+}
+
+func TestFormatAsFwCommandsExpired(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+
+	expired := ActiveIptablesRule{Chain: "FORWARD", JumpTo: DOCKER_CHAIN, Expires: &past}
+	expired.Source, expired.Destination = "198.51.100.1/32", "172.17.0.2/32"
+	expired.Protocol, expired.DestinationPort = "tcp", 443
+	active := expired
+	active.Source, active.Expires = "198.51.100.2/32", &future
+
+	c := IptablesRulesCollection{
+		Rules: []*ActiveIptablesRule{&expired, &active},
+		AllowLists: []*AllowList{{Addresses: []*AllowedAddress{
+			{Address: "203.0.113.1/32", Expires: &past},
+			{Address: "203.0.113.2/32", Expires: &future},
+		}}},
+	}
+
+	lines := c.FormatAsFwCommands("web")
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 lines, got %v", lines)
+	}
+	for i, line := range lines {
+		// expired entries cannot be fed back through '--from'
+		commented := strings.HasPrefix(line, "# expired: ")
+		if commented != (i%2 == 0) {
+			t.Errorf("line %d: unexpected %q", i, line)
+		}
+		if !commented && strings.Contains(line, "--expires") {
+			t.Errorf("line %d: expected a time-to-live, got %q", i, line)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+/*
+ * docker-fw v0.2.4 - a complementary tool for Docker to manage custom
+ *                    firewall rules between/towards Docker containers
+ * Copyright (C) 2014~2016 gdm85 - https://github.com/gdm85/docker-fw/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	LABEL_PREFIX     = "docker-fw."
+	LABEL_ALLOW      = LABEL_PREFIX + "allow"
+	LABEL_DEPENDS_ON = LABEL_PREFIX + "depends-on"
+	LABEL_PRIORITY   = LABEL_PREFIX + "priority"
+)
+
+// labels declaring rules, with the corresponding add action
+var labelActions = map[string]string{
+	LABEL_PREFIX + "add":      "add",
+	LABEL_PREFIX + "internal": "add-internal",
+	LABEL_PREFIX + "input":    "add-input",
+}
+
+// a rule declared in a label, e.g. 'src=web,dport=5432'
+type labelRuleSpec struct {
+	Source, Dest         string
+	SourcePort, DestPort uint16
+	Protocol             string
+}
+
+// parse the value of a rules label; multiple rules are separated by ';'
+func parseLabelRules(label, value string) ([]*labelRuleSpec, error) {
+	specs := []*labelRuleSpec{}
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		spec := labelRuleSpec{Source: ".", Dest: ".", Protocol: "tcp"}
+		for _, option := range strings.Split(entry, ",") {
+			parts := strings.SplitN(strings.TrimSpace(option), "=", 2)
+			if len(parts) != 2 {
+				return nil, errors.New(fmt.Sprintf("label %s: invalid option '%s'", label, option))
+			}
+
+			switch parts[0] {
+			case "src":
+				spec.Source = parts[1]
+			case "dst":
+				spec.Dest = parts[1]
+			case "sport", "dport":
+				port, err := strconv.ParseUint(parts[1], 10, 16)
+				if err != nil || port == 0 {
+					return nil, errors.New(fmt.Sprintf("label %s: invalid port '%s'", label, parts[1]))
+				}
+				if parts[0] == "sport" {
+					spec.SourcePort = uint16(port)
+				} else {
+					spec.DestPort = uint16(port)
+				}
+			case "proto":
+				if parts[1] != "tcp" && parts[1] != "udp" {
+					return nil, errors.New(fmt.Sprintf("label %s: invalid protocol '%s'", label, parts[1]))
+				}
+				spec.Protocol = parts[1]
+			default:
+				return nil, errors.New(fmt.Sprintf("label %s: unknown option '%s'", label, parts[0]))
+			}
+		}
+
+		specs = append(specs, &spec)
+	}
+	return specs, nil
+}
+
+// address of a label rule that references a container which is not running, if any
+func offlineLabelAddress(spec *labelRuleSpec) (string, error) {
+	for _, address := range []string{spec.Source, spec.Dest} {
+		if address == "." || address == "/" || address == DOCKER_HOST || isMultiAddressAlias(address) || matchIpv4.MatchString(address) {
+			continue
+		}
+		_, err := ccl.LookupOnlineContainer(address)
+		if err != nil {
+			return address, err
+		}
+	}
+	return "", nil
+}
+
+// generate the rules declared in the labels of container; labels with rules that reference containers
+// which are not running are deferred and returned separately, their rules are not generated
+func labelRules(container *docker.Container) ([]*ActiveIptablesRule, []string, error) {
+	if container.Config == nil {
+		return nil, nil, nil
+	}
+
+	// process labels in a stable order
+	labels := []string{}
+	for label := range container.Config.Labels {
+		if _, ok := labelActions[label]; ok {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+
+	rules := []*ActiveIptablesRule{}
+	deferred := []string{}
+	for _, label := range labels {
+		action := labelActions[label]
+		specs, err := parseLabelRules(label, container.Config.Labels[label])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, spec := range specs {
+			if (action == "add-internal" || action == "add-input") && spec.DestPort == 0 {
+				return nil, nil, errors.New(fmt.Sprintf("label %s: dport is mandatory", label))
+			}
+
+			address, err := offlineLabelAddress(spec)
+			if err != nil {
+				log.Printf("WARNING: label %s of container '%s': rule deferred, '%s' is not available: %s", label, container.Name[1:], address, err)
+				if !inArray(deferred, label) {
+					deferred = append(deferred, label)
+				}
+				continue
+			}
+
+			iptRules, err := NewIptablesRule(container.ID, spec.Source, spec.SourcePort, spec.Dest, spec.DestPort, spec.Protocol, "", false)
+			if err != nil {
+				return nil, nil, errors.New(fmt.Sprintf("label %s: %s", label, err))
+			}
+
+			for _, iptRule := range iptRules {
+				r := ActiveIptablesRule{Label: label}
+				switch action {
+				case "add":
+					if isDockerIPv4(iptRule.Source) && isDockerIPv4(iptRule.Destination) {
+						return nil, nil, errors.New(fmt.Sprintf("label %s: trying to add an external firewall rule for internal Docker traffic", label))
+					}
+					r.Chain, r.JumpTo = "FORWARD", DOCKER_CHAIN
+				case "add-internal":
+					r.Chain, r.JumpTo = DOCKER_CHAIN, "ACCEPT"
+				case "add-input":
+					r.Chain, r.JumpTo = "INPUT", "ACCEPT"
+				}
+				r.IptablesRule = *iptRule
+
+				rules = append(rules, &r)
+			}
+		}
+	}
+
+	return rules, deferred, nil
+}
+
+// addresses declared in the allow label of container
+func labelAllowedAddresses(container *docker.Container) ([]string, error) {
+	if container.Config == nil {
+		return nil, nil
+	}
+	value, ok := container.Config.Labels[LABEL_ALLOW]
+	if !ok {
+		return nil, nil
+	}
+
+	addresses := []string{}
+	for _, entry := range strings.Split(value, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		address, err := normalizeAllowedAddress(entry)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("label %s: %s", LABEL_ALLOW, err))
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, nil
+}
+
+// reconcile rules and allowed addresses recorded from labels with the current labels of container;
+// rules that are no more declared are removed from the collection and returned, while new ones are added
+// to it (and must then be applied); the boolean return value is true if there was any change
+// recorded rules of deferred labels are kept until their referenced containers are running again
+func (c *IptablesRulesCollection) reconcileLabels(container *docker.Container) ([]*ActiveIptablesRule, bool, error) {
+	desired, deferred, err := labelRules(container)
+	if err != nil {
+		return nil, false, err
+	}
+
+	missing := map[string]*ActiveIptablesRule{}
+	keys := []string{}
+	for _, r := range desired {
+		key := r.Format() + "\n" + r.Aliases()
+		if _, ok := missing[key]; ok {
+			continue
+		}
+		missing[key] = r
+		keys = append(keys, key)
+	}
+
+	changed := false
+	kept := []*ActiveIptablesRule{}
+	stale := []*ActiveIptablesRule{}
+	for _, r := range c.Rules {
+		if r.Label == "" {
+			kept = append(kept, r)
+			continue
+		}
+
+		key := r.Format() + "\n" + r.Aliases()
+		if _, ok := missing[key]; !ok {
+			if inArray(deferred, r.Label) {
+				kept = append(kept, r)
+				continue
+			}
+			stale = append(stale, r)
+			changed = true
+			continue
+		}
+		delete(missing, key)
+		kept = append(kept, r)
+	}
+	for _, key := range keys {
+		if r, ok := missing[key]; ok {
+			kept = append(kept, r)
+			changed = true
+		}
+	}
+	c.Rules = kept
+
+	// addresses of the allow label are part of the plain allow list, their rules are regenerated with it
+	addresses, err := labelAllowedAddresses(container)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(addresses) != 0 || len(c.AllowLists) != 0 {
+		l := c.FindAllowList(false)
+
+		keptAddresses := []*AllowedAddress{}
+		for _, a := range l.Addresses {
+			if a.Label != "" && !inArray(addresses, a.Address) {
+				changed = true
+				continue
+			}
+			keptAddresses = append(keptAddresses, a)
+		}
+		l.Addresses = keptAddresses
+
+		for _, address := range addresses {
+			if l.Find(address) == nil {
+				l.Addresses = append(l.Addresses, &AllowedAddress{Address: address, Label: LABEL_ALLOW})
+				changed = true
+			}
+		}
+
+		// do not keep around an empty list created above
+		if len(l.Addresses) == 0 {
+			lists := []*AllowList{}
+			for _, other := range c.AllowLists {
+				if other != l {
+					lists = append(lists, other)
+				}
+			}
+			c.AllowLists = lists
+		}
+	}
+
+	return stale, changed, nil
+}
@@ -0,0 +1,295 @@
+/*
+ * docker-fw v0.2.4 - a complementary tool for Docker to manage custom
+ *                    firewall rules between/towards Docker containers
+ * Copyright (C) 2014~2016 gdm85 - https://github.com/gdm85/docker-fw/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// rules of the FORWARD chain layout, see README and example-iptables.txt
+const (
+	LAYOUT_DOCKER_LINK   = "FORWARD -o docker0 -j " + DOCKER_CHAIN
+	LAYOUT_ICC_ACCEPT    = "FORWARD -i docker0 -o docker0 -j ACCEPT"
+	LAYOUT_INTERNAL_LINK = "FORWARD -i docker0 -o docker0 -j " + DOCKER_CHAIN
+	LAYOUT_CONNTRACK     = "FORWARD -o docker0 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT"
+	LAYOUT_OUTBOUND      = "FORWARD -i docker0 ! -o docker0 -j ACCEPT"
+	LAYOUT_EGRESS_LINK   = "FORWARD -i docker0 ! -o docker0 -j " + EGRESS_CHAIN
+	LAYOUT_EGRESS_RETURN = EGRESS_CHAIN + " -m conntrack --ctstate RELATED,ESTABLISHED -j RETURN"
+	LAYOUT_DROP          = "FORWARD -i docker0 -o docker0 -j DROP"
+)
+
+// kinds of layout findings, one for each rule of the layout
+const (
+	LAYOUT_FINDING_DOCKER_LINK   = "docker-link"
+	LAYOUT_FINDING_ICC           = "icc"
+	LAYOUT_FINDING_INTERNAL_LINK = "internal-link"
+	LAYOUT_FINDING_CONNTRACK     = "conntrack"
+	LAYOUT_FINDING_OUTBOUND      = "outbound"
+	LAYOUT_FINDING_EGRESS        = "egress"
+	LAYOUT_FINDING_DROP          = "drop"
+)
+
+// a deviation from the expected layout, together with its fix
+type layoutFinding struct {
+	Kind    string
+	Problem string
+	// fix moves rules that already exist, thus is applied only with 'init --fix'
+	Reorder bool
+	Fix     func() error
+}
+
+// current rules of a chain, in the same format used for rules by docker-fw
+func listChain(chain string) ([]string, error) {
+	exitCode, stdo, stde, err := iptablesRun("--wait -S "+chain, false)
+	if err != nil {
+		return nil, err
+	}
+	if exitCode != 0 {
+		fmt.Fprintln(os.Stderr, stde)
+		return nil, errors.New("cannot list rules of chain " + chain)
+	}
+
+	rules := []string{}
+	prefix := "-A " + chain + " "
+	for _, line := range strings.Split(stdo, "\n") {
+		if strings.HasPrefix(line, prefix) {
+			rules = append(rules, chain+" "+line[len(prefix):])
+		}
+	}
+	return rules, nil
+}
+
+// 1-based position of rule in chain, 0 if not found
+func rulePosition(rules []string, rule string) int {
+	for i, r := range rules {
+		if r == rule {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// insert rule just before the terminal drop, or append it if there is none
+func insertBeforeDrop(rule string) error {
+	rules, err := listChain("FORWARD")
+	if err != nil {
+		return err
+	}
+
+	pos := rulePosition(rules, LAYOUT_DROP)
+	if pos == 0 {
+		return internalAppend("init", rule)
+	}
+	return internalInsert(pos, rule)
+}
+
+// insert rule just after the internal link, or on top if there is none
+func insertAfterInternalLink(rule string) error {
+	rules, err := listChain("FORWARD")
+	if err != nil {
+		return err
+	}
+
+	return internalInsert(rulePosition(rules, LAYOUT_INTERNAL_LINK)+1, rule)
+}
+
+func moveRule(rule string, insert func() error) func() error {
+	return func() error {
+		err := internalDelete(rule, false)
+		if err != nil {
+			return err
+		}
+		return insert()
+	}
+}
+
+// compare the FORWARD chain with the expected layout
+// egress layout is verified only when requested or when already initialized
+func checkLayout(egress bool) ([]*layoutFinding, error) {
+	exists, err := chainExists(DOCKER_CHAIN)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.New("chain DOCKER not found, is Docker daemon running with iptables enabled?")
+	}
+
+	if !egress {
+		egress, err = chainExists(EGRESS_CHAIN)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rules, err := listChain("FORWARD")
+	if err != nil {
+		return nil, err
+	}
+	has := func(rule string) bool {
+		return rulePosition(rules, rule) != 0
+	}
+
+	findings := []*layoutFinding{}
+	deleteRule := func(rule string) func() error {
+		return func() error {
+			return internalDelete(rule, false)
+		}
+	}
+	insertOnTop := func(rule string) func() error {
+		return func() error {
+			return internalInsert(1, rule)
+		}
+	}
+	afterInternalLink := func(rule string) func() error {
+		return func() error {
+			return insertAfterInternalLink(rule)
+		}
+	}
+	appendRule := func(rule string) func() error {
+		return func() error {
+			return internalAppend("init", rule)
+		}
+	}
+	beforeDrop := func(rule string) func() error {
+		return func() error {
+			return insertBeforeDrop(rule)
+		}
+	}
+
+	// this Docker-added rule must be disposed, see https://github.com/docker/docker/issues/6034#issuecomment-58742268
+	if has(LAYOUT_DOCKER_LINK) {
+		findings = append(findings, &layoutFinding{Kind: LAYOUT_FINDING_DOCKER_LINK, Problem: "Docker-added rule '" + LAYOUT_DOCKER_LINK + "' must be removed", Fix: deleteRule(LAYOUT_DOCKER_LINK)})
+	}
+	// added by Docker when running with --icc=true, would accept all internal traffic not whitelisted in DOCKER chain
+	if has(LAYOUT_ICC_ACCEPT) {
+		findings = append(findings, &layoutFinding{Kind: LAYOUT_FINDING_ICC, Problem: "Docker-added rule '" + LAYOUT_ICC_ACCEPT + "' must be removed", Fix: deleteRule(LAYOUT_ICC_ACCEPT)})
+	}
+
+	// internal traffic must be linked to DOCKER chain before anything else, since FORWARD rules of
+	// containers are inserted right after it (see ActiveIptablesRule.Position)
+	pos := rulePosition(rules, LAYOUT_INTERNAL_LINK)
+	if pos == 0 {
+		findings = append(findings, &layoutFinding{Kind: LAYOUT_FINDING_INTERNAL_LINK, Problem: "rule '" + LAYOUT_INTERNAL_LINK + "' is missing", Fix: insertOnTop(LAYOUT_INTERNAL_LINK)})
+	} else if pos != 1 {
+		findings = append(findings, &layoutFinding{Kind: LAYOUT_FINDING_INTERNAL_LINK, Problem: "rule '" + LAYOUT_INTERNAL_LINK + "' is not on top", Reorder: true, Fix: moveRule(LAYOUT_INTERNAL_LINK, insertOnTop(LAYOUT_INTERNAL_LINK))})
+	}
+
+	if !has(LAYOUT_CONNTRACK) {
+		findings = append(findings, &layoutFinding{Kind: LAYOUT_FINDING_CONNTRACK, Problem: "rule '" + LAYOUT_CONNTRACK + "' is missing", Fix: beforeDrop(LAYOUT_CONNTRACK)})
+	}
+	if !has(LAYOUT_OUTBOUND) {
+		findings = append(findings, &layoutFinding{Kind: LAYOUT_FINDING_OUTBOUND, Problem: "rule '" + LAYOUT_OUTBOUND + "' is missing", Fix: beforeDrop(LAYOUT_OUTBOUND)})
+	}
+
+	if egress {
+		exists, err := chainExists(EGRESS_CHAIN)
+		if err != nil {
+			return nil, err
+		}
+		returnExists := false
+		if exists {
+			returnExists, err = RuleExists(LAYOUT_EGRESS_RETURN)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		pos := rulePosition(rules, LAYOUT_EGRESS_LINK)
+		if !exists || !returnExists || pos == 0 {
+			findings = append(findings, &layoutFinding{Kind: LAYOUT_FINDING_EGRESS, Problem: "egress chain " + EGRESS_CHAIN + " is not fully initialized", Fix: initializeEgress})
+		} else if outbound := rulePosition(rules, LAYOUT_OUTBOUND); outbound != 0 && outbound < pos {
+			findings = append(findings, &layoutFinding{Kind: LAYOUT_FINDING_EGRESS, Problem: "rule '" + LAYOUT_EGRESS_LINK + "' must precede '" + LAYOUT_OUTBOUND + "'", Reorder: true, Fix: moveRule(LAYOUT_EGRESS_LINK, afterInternalLink(LAYOUT_EGRESS_LINK))})
+		}
+	}
+
+	// the terminal drop must follow all the accept rules of the layout
+	pos = rulePosition(rules, LAYOUT_DROP)
+	if pos == 0 {
+		findings = append(findings, &layoutFinding{Kind: LAYOUT_FINDING_DROP, Problem: "terminal rule '" + LAYOUT_DROP + "' is missing", Fix: appendRule(LAYOUT_DROP)})
+	} else {
+		for _, rule := range []string{LAYOUT_INTERNAL_LINK, LAYOUT_CONNTRACK, LAYOUT_OUTBOUND} {
+			if rulePosition(rules, rule) > pos {
+				findings = append(findings, &layoutFinding{Kind: LAYOUT_FINDING_DROP, Problem: "terminal rule '" + LAYOUT_DROP + "' is not after '" + rule + "'", Reorder: true, Fix: moveRule(LAYOUT_DROP, appendRule(LAYOUT_DROP))})
+				break
+			}
+		}
+	}
+
+	return findings, nil
+}
+
+// corresponding to a subcommand ('init')
+// without check/fix, missing rules are added and unwanted ones removed, while misplaced rules are only reported;
+// returns exit code 1 if the layout is not as expected
+func InitializeFirewall(egress, check, fix bool) (int, error) {
+	// check if daemon is running
+	err := Docker.Ping()
+	if err != nil {
+		return 2, err
+	}
+
+	return initializeLayout(egress, check, fix)
+}
+
+func initializeLayout(egress, check, fix bool) (int, error) {
+	findings, err := checkLayout(egress)
+	if err != nil {
+		return 2, err
+	}
+
+	if !check {
+		for _, f := range findings {
+			if f.Reorder && !fix {
+				continue
+			}
+			err := f.Fix()
+			if err != nil {
+				return 2, err
+			}
+			fmt.Printf("docker-fw: layout: fixed: %s\n", f.Problem)
+		}
+
+		// verify again the result
+		findings, err = checkLayout(egress)
+		if err != nil {
+			return 2, err
+		}
+	}
+
+	for _, f := range findings {
+		if f.Reorder && !check && !fix {
+			fmt.Printf("docker-fw: layout: %s (use --fix)\n", f.Problem)
+		} else {
+			fmt.Printf("docker-fw: layout: %s\n", f.Problem)
+		}
+	}
+	if len(findings) != 0 {
+		return 1, nil
+	}
+
+	if check {
+		fmt.Printf("docker-fw: layout: ok\n")
+	}
+	return 0, nil
+}
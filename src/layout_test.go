@@ -0,0 +1,86 @@
+/*
+ * docker-fw v0.2.4 - a complementary tool for Docker to manage custom
+ *                    firewall rules between/towards Docker containers
+ * Copyright (C) 2014~2016 gdm85 - https://github.com/gdm85/docker-fw/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+// FORWARD chain as left by Docker daemon at startup, with --icc=true
+var dockerForwardChain = []string{
+	"-o docker0 -j DOCKER",
+	"-o docker0 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT",
+	"-i docker0 ! -o docker0 -j ACCEPT",
+	"-i docker0 -o docker0 -j ACCEPT",
+}
+
+func TestInitEgressThenAddKeepsLayout(t *testing.T) {
+	resetFakeIptables(t, map[string][]string{"FORWARD": dockerForwardChain, "DOCKER": {}})
+
+	// init --egress
+	exitCode, err := initializeLayout(true, false, false)
+	if err != nil || exitCode != 0 {
+		t.Fatalf("init --egress: exit code %d, error %v", exitCode, err)
+	}
+
+	// add
+	r := ActiveIptablesRule{Chain: "FORWARD", JumpTo: DOCKER_CHAIN}
+	r.Source, r.Destination, r.Protocol, r.DestinationPort = "203.0.113.7/32", "172.17.0.2/32", "tcp", 443
+	err = internalInsert(r.Position(), r.Format())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// init --check
+	exitCode, err = initializeLayout(false, true, false)
+	if err != nil || exitCode != 0 {
+		t.Fatalf("init --check after add: exit code %d, error %v", exitCode, err)
+	}
+}
+
+func TestCheckLayoutInternalLinkOnTop(t *testing.T) {
+	// egress link on top, as placed by previous versions
+	resetFakeIptables(t, map[string][]string{
+		"FORWARD": {
+			LAYOUT_EGRESS_LINK[len("FORWARD "):],
+			LAYOUT_INTERNAL_LINK[len("FORWARD "):],
+			LAYOUT_CONNTRACK[len("FORWARD "):],
+			LAYOUT_OUTBOUND[len("FORWARD "):],
+			LAYOUT_DROP[len("FORWARD "):],
+		},
+		"DOCKER":     {},
+		EGRESS_CHAIN: {LAYOUT_EGRESS_RETURN[len(EGRESS_CHAIN+" "):]},
+	})
+
+	findings, err := checkLayout(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 1 || findings[0].Kind != LAYOUT_FINDING_INTERNAL_LINK || !findings[0].Reorder {
+		t.Fatalf("expected the internal link to be reported as not on top, got %d finding(s)", len(findings))
+	}
+
+	// init --fix
+	exitCode, err := initializeLayout(false, false, true)
+	if err != nil || exitCode != 0 {
+		t.Fatalf("init --fix: exit code %d, error %v", exitCode, err)
+	}
+}
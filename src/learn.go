@@ -0,0 +1,321 @@
+/*
+ * docker-fw v0.2.4 - a complementary tool for Docker to manage custom
+ *                    firewall rules between/towards Docker containers
+ * Copyright (C) 2014~2016 gdm85 - https://github.com/gdm85/docker-fw/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	LEARN_LOG_PREFIX = "docker-fw-learn: "
+	KERNEL_LOG       = "/dev/kmsg"
+)
+
+// a flow as seen through the kernel log of the audit rules
+type learnedFlow struct {
+	Internal    bool
+	Source      string
+	Destination string
+	DestPort    uint16
+	Protocol    string
+}
+
+// audit rules that log and then accept new connections towards a container
+// internal traffic is audited at the bottom of the DOCKER chain, external traffic just before the terminal drop
+// of the FORWARD chain, thus in both cases only after all whitelisted flows
+func learnAuditRules(container *docker.Container) (internal []string, external []string) {
+	containerIpv4 := container.NetworkSettings.IPAddress + "/32"
+	logTarget := fmt.Sprintf("-m conntrack --ctstate NEW -j LOG --log-prefix '%s'", LEARN_LOG_PREFIX)
+
+	internal = []string{
+		fmt.Sprintf("%s -d %s -i docker0 -o docker0 %s", DOCKER_CHAIN, containerIpv4, logTarget),
+		fmt.Sprintf("%s -d %s -i docker0 -o docker0 -j ACCEPT", DOCKER_CHAIN, containerIpv4),
+	}
+	external = []string{
+		fmt.Sprintf("FORWARD -d %s ! -i docker0 -o docker0 %s", containerIpv4, logTarget),
+		fmt.Sprintf("FORWARD -d %s ! -i docker0 -o docker0 -j ACCEPT", containerIpv4),
+	}
+	return
+}
+
+// parse a kernel log record produced by one of the audit rules
+func parseLearnedFlow(record string) (*learnedFlow, bool) {
+	pos := strings.Index(record, LEARN_LOG_PREFIX)
+	if pos == -1 {
+		return nil, false
+	}
+
+	values := map[string]string{}
+	for _, field := range strings.Fields(record[pos+len(LEARN_LOG_PREFIX):]) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) == 2 {
+			values[parts[0]] = parts[1]
+		}
+	}
+
+	proto := strings.ToLower(values["PROTO"])
+	if proto != "tcp" && proto != "udp" {
+		// only flows that can be expressed with add actions are of interest
+		return nil, false
+	}
+
+	dport, err := strconv.ParseUint(values["DPT"], 10, 16)
+	if err != nil || values["SRC"] == "" || values["DST"] == "" {
+		return nil, false
+	}
+
+	return &learnedFlow{
+		Internal:    values["IN"] == "docker0" && values["OUT"] == "docker0",
+		Source:      values["SRC"],
+		Destination: values["DST"],
+		DestPort:    uint16(dport),
+		Protocol:    proto,
+	}, true
+}
+
+// read kernel log records as they arrive, starting from the current end of the log
+// the log is closed and reading stops once done is closed
+func followKernelLog(records chan<- string, done <-chan struct{}) error {
+	f, err := os.Open(KERNEL_LOG)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Seek(0, io.SeekEnd)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	go func() {
+		<-done
+		_ = f.Close()
+	}()
+
+	go func() {
+		// each read returns exactly one record
+		buf := make([]byte, 8192)
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				if errors.Is(err, syscall.EPIPE) {
+					// some records were overwritten before being read, keep going
+					continue
+				}
+				close(records)
+				return
+			}
+			select {
+			case records <- string(buf[:n]):
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// convert a flow into the rule that would have allowed it
+func (flow *learnedFlow) proposeRule(container *docker.Container) (*ActiveIptablesRule, error) {
+	rule := ActiveIptablesRule{}
+	rule.Destination = container.NetworkSettings.IPAddress + "/32"
+	rule.DestinationAlias = "."
+	rule.DestinationPort = flow.DestPort
+	rule.Protocol = flow.Protocol
+
+	if flow.Internal {
+		var err error
+		rule.Source, rule.SourceAlias, err = ccl.ParseAddress(flow.Source+"/32", container, true)
+		if err != nil {
+			return nil, err
+		}
+		rule.Chain = DOCKER_CHAIN
+		rule.JumpTo = "ACCEPT"
+	} else {
+		rule.Source = flow.Source + "/32"
+		rule.Chain = "FORWARD"
+		rule.JumpTo = DOCKER_CHAIN
+	}
+
+	return &rule, nil
+}
+
+// install the audit rules of all containers, returning them for removal
+// the lock is held only while changing iptables, not for the whole learning
+func installAuditRules(byAddress map[string]*docker.Container) ([]string, error) {
+	lock, err := acquireLock()
+	if err != nil {
+		return nil, err
+	}
+	defer releaseLock(lock)
+
+	installed := []string{}
+	for _, container := range byAddress {
+		internal, external := learnAuditRules(container)
+		for _, rule := range internal {
+			err := internalAppend(container.Name[1:], rule)
+			if err != nil {
+				removeInstalledAuditRules(installed)
+				return nil, err
+			}
+			installed = append(installed, rule)
+		}
+		for _, rule := range external {
+			err := insertBeforeDrop(rule)
+			if err != nil {
+				removeInstalledAuditRules(installed)
+				return nil, err
+			}
+			installed = append(installed, rule)
+		}
+	}
+	return installed, nil
+}
+
+func removeAuditRules(installed []string) {
+	lock, err := acquireLock()
+	if err != nil {
+		log.Printf("learn: cannot acquire lock, removing audit rules anyway: %s", err)
+	} else {
+		defer releaseLock(lock)
+	}
+
+	removeInstalledAuditRules(installed)
+}
+
+// remove audit rules in reverse order of installation; lock must be held
+func removeInstalledAuditRules(installed []string) {
+	for i := len(installed) - 1; i >= 0; i-- {
+		err := internalDelete(installed[i], false)
+		if err != nil {
+			log.Printf("learn: could not remove audit rule '%s': %s", installed[i], err)
+		}
+	}
+}
+
+// corresponding to a subcommand ('learn')
+// install audit rules for the specified containers, collect all flows that would otherwise
+// be dropped and print the add actions that would allow them
+func LearnRules(containerIds []string, duration time.Duration) error {
+	// needed to map back source addresses to container names
+	err := ccl.LoadAllContainers()
+	if err != nil {
+		return err
+	}
+
+	byAddress := map[string]*docker.Container{}
+	for _, cid := range containerIds {
+		container, err := ccl.LookupOnlineContainer(cid)
+		if err != nil {
+			return err
+		}
+		byAddress[container.NetworkSettings.IPAddress] = container
+	}
+
+	records := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	err = followKernelLog(records, done)
+	if err != nil {
+		return err
+	}
+
+	installed, err := installAuditRules(byAddress)
+	if err != nil {
+		return err
+	}
+	defer removeAuditRules(installed)
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupted)
+
+	var timeout <-chan time.Time
+	if duration != 0 {
+		timeout = time.After(duration)
+	}
+
+	log.Printf("learn: collecting flows for %d container(s), interrupt to stop", len(byAddress))
+
+	flows := map[learnedFlow]bool{}
+	collecting := true
+	for collecting {
+		select {
+		case record, ok := <-records:
+			if !ok {
+				log.Printf("learn: kernel log is no more readable, stopping")
+				collecting = false
+				continue
+			}
+			flow, ok := parseLearnedFlow(record)
+			if !ok {
+				continue
+			}
+			if _, ok := byAddress[flow.Destination]; ok {
+				flows[*flow] = true
+			}
+		case <-interrupted:
+			collecting = false
+		case <-timeout:
+			collecting = false
+		}
+	}
+
+	log.Printf("learn: %d distinct flow(s) observed", len(flows))
+
+	// whitelisted flows never reach the audit rules, thus all flows are proposed
+	proposals := map[string]bool{}
+	for flow := range flows {
+		container := byAddress[flow.Destination]
+
+		rule, err := flow.proposeRule(container)
+		if err != nil {
+			log.Printf("learn: skipping flow from %s to %s: %s", flow.Source, container.Name[1:], err)
+			continue
+		}
+
+		proposals[rule.FormatAsFwCommand(container.Name[1:])] = true
+	}
+
+	lines := []string{}
+	for line := range proposals {
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+
+	return nil
+}
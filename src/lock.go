@@ -0,0 +1,56 @@
+/*
+ * docker-fw v0.2.4 - a complementary tool for Docker to manage custom
+ *                    firewall rules between/towards Docker containers
+ * Copyright (C) 2014~2016 gdm85 - https://github.com/gdm85/docker-fw/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+const LOCK_FILE = "/var/lib/docker/docker-fw.lock"
+
+// actions that change iptables or the json descriptors, serialised through the lock file
+// NOTE: 'learn' acquires the lock by itself, only while installing and removing its audit rules
+var lockedActions = map[string]bool{
+	"init": true, "start": true, "stop": true, "restart": true, "allow": true, "revoke": true, "add": true, "add-input": true, "add-two-ways": true,
+	"add-internal": true, "add-egress": true, "egress-policy": true, "forward": true, "save-hostconfig": true,
+	"replay": true, "drop": true, "expire": true, "group": true,
+}
+
+// block until the exclusive lock is acquired; it is released with releaseLock or when the process exits
+func acquireLock() (*os.File, error) {
+	f, err := os.OpenFile(LOCK_FILE, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func releaseLock(f *os.File) {
+	_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	_ = f.Close()
+}
@@ -23,6 +23,8 @@ package main
 import (
 	"errors"
 	"fmt"
+	"net"
+	"sort"
 	"strings"
 
 	"github.com/fsouza/go-dockerclient"
@@ -38,6 +40,11 @@ type CachedContainerLookup struct {
 	loadedAll bool
 }
 
+// discard all cached containers, e.g. between requests of a long-running process
+func resetContainerCache() {
+	ccl = &CachedContainerLookup{containers: map[string]*docker.Container{}, networkAddress: map[string]*docker.Container{}}
+}
+
 func (ccl *CachedContainerLookup) GetAllContainers() []*docker.Container {
 	lookupByPtr := map[*docker.Container]bool{}
 	for _, container := range ccl.containers {
@@ -204,6 +211,78 @@ func applySelfReduction(foundContainer *docker.Container, self *docker.Container
 	return foundContainer.Name[1:]
 }
 
+const DNS_ALIAS_PREFIX = "dns:"
+
+// used to resolve 'dns:' addresses, can be replaced e.g. by a hosts file lookup
+var lookupHost = net.LookupHost
+
+// aliases that can resolve to more than one address, thus to more than one rule
+func isMultiAddressAlias(alias string) bool {
+	return strings.HasPrefix(alias, DNS_ALIAS_PREFIX) || strings.HasPrefix(alias, GROUP_ALIAS_PREFIX)
+}
+
+// resolve all IPv4 addresses of a hostname, sorted
+func resolveHostIPv4(hostname string) ([]string, error) {
+	answers, err := lookupHost(hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := []string{}
+	for _, answer := range answers {
+		ip := net.ParseIP(answer)
+		if ip == nil || ip.To4() == nil {
+			continue
+		}
+		address := ip.To4().String() + "/32"
+		if !inArray(addresses, address) {
+			addresses = append(addresses, address)
+		}
+	}
+
+	if len(addresses) == 0 {
+		return nil, errors.New("no IPv4 address found for host " + hostname)
+	}
+
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+// same as ParseAddress(), but also accepts aliases that resolve to multiple addresses,
+// e.g. 'dns:' followed by a hostname is resolved to all its IPv4 addresses
+// and '@' followed by a group name is resolved to all the group members
+func (ccl *CachedContainerLookup) ParseAddresses(addressOrAlias string, self *docker.Container, parseContainerNames bool) ([]string, string, error) {
+	if strings.HasPrefix(addressOrAlias, GROUP_ALIAS_PREFIX) {
+		addresses, err := resolveGroup(addressOrAlias)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return addresses, addressOrAlias, nil
+	}
+
+	if strings.HasPrefix(addressOrAlias, DNS_ALIAS_PREFIX) {
+		hostname := addressOrAlias[len(DNS_ALIAS_PREFIX):]
+		if len(hostname) == 0 {
+			return nil, "", errors.New("empty hostname in address " + addressOrAlias)
+		}
+
+		addresses, err := resolveHostIPv4(hostname)
+		if err != nil {
+			return nil, "", err
+		}
+
+		return addresses, addressOrAlias, nil
+	}
+
+	ipv4, alias, err := ccl.ParseAddress(addressOrAlias, self, parseContainerNames)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return []string{ipv4}, alias, nil
+}
+
 // first return value is ipv4
 // second return value is alias (names preferred over IDs)
 func (ccl *CachedContainerLookup) ParseAddress(addressOrAlias string, self *docker.Container, parseContainerNames bool) (string, string, error) {
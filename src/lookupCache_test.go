@@ -0,0 +1,66 @@
+/*
+ * docker-fw v0.2.4 - a complementary tool for Docker to manage custom
+ *                    firewall rules between/towards Docker containers
+ * Copyright (C) 2014~2016 gdm85 - https://github.com/gdm85/docker-fw/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// replace lookupHost with a hosts-file stand-in for the duration of a test
+func fakeLookupHost(t *testing.T, hosts map[string][]string) {
+	orig := lookupHost
+	lookupHost = func(hostname string) ([]string, error) {
+		answers, ok := hosts[hostname]
+		if !ok {
+			return nil, errors.New("no such host: " + hostname)
+		}
+		return answers, nil
+	}
+	t.Cleanup(func() {
+		lookupHost = orig
+	})
+}
+
+func TestParseAddressesDns(t *testing.T) {
+	fakeLookupHost(t, map[string][]string{
+		"api.example.test": {"198.51.100.7", "2001:db8::7", "198.51.100.3", "198.51.100.7"},
+	})
+
+	addresses, alias, err := ccl.ParseAddresses("dns:api.example.test", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alias != "dns:api.example.test" {
+		t.Errorf("unexpected alias: %s", alias)
+	}
+	// IPv6 answers and duplicates are ignored, one address for each IPv4 answer
+	expected := []string{"198.51.100.3/32", "198.51.100.7/32"}
+	if !reflect.DeepEqual(addresses, expected) {
+		t.Errorf("expected %v, got %v", expected, addresses)
+	}
+
+	_, _, err = ccl.ParseAddresses("dns:missing.example.test", nil, false)
+	if err == nil {
+		t.Error("expected an error for an unknown host")
+	}
+}
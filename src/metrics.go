@@ -0,0 +1,303 @@
+/*
+ * docker-fw v0.2.4 - a complementary tool for Docker to manage custom
+ *                    firewall rules between/towards Docker containers
+ * Copyright (C) 2014~2016 gdm85 - https://github.com/gdm85/docker-fw/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const IPTABLES_SAVE_BINARY = "iptables-save"
+
+// packet/byte counters of a recorded rule
+type ruleCounter struct {
+	Container string
+	Rule      *ActiveIptablesRule
+	Packets   uint64
+	Bytes     uint64
+	// false if the rule could not be found in iptables
+	Present bool
+}
+
+// the other end of the flow, as specified when creating the rule
+func (rc *ruleCounter) Peer() string {
+	r := rc.Rule
+	if r.DestinationAlias == "." {
+		if r.SourceSet != "" {
+			return "ipset:" + r.SourceSet
+		}
+		return r.SourceAliasOrAddress()
+	}
+	return r.DestinationAliasOrAddress()
+}
+
+func (rc *ruleCounter) Port() string {
+	if rc.Rule.DestinationPort == 0 {
+		return ""
+	}
+	return strconv.Itoa(int(rc.Rule.DestinationPort))
+}
+
+// key used to match rules regardless of the order in which iptables prints their options;
+// each option is kept together with its arguments and with a preceding negation ('!'),
+// while the '/32' suffix is dropped since iptables-save omits it for some matches (e.g. '--ctorigdst')
+func counterKey(table, chain string, options []string) string {
+	groups := []string{}
+	negated := false
+	for _, option := range options {
+		option = strings.TrimSuffix(option, "/32")
+		if option == "!" {
+			negated = true
+			continue
+		}
+		if strings.HasPrefix(option, "-") || len(groups) == 0 {
+			if negated {
+				option = "! " + option
+				negated = false
+			}
+			groups = append(groups, option)
+			continue
+		}
+		groups[len(groups)-1] += " " + option
+	}
+	sort.Strings(groups)
+	return table + "\n" + chain + "\n" + strings.Join(groups, "\n")
+}
+
+func (r *ActiveIptablesRule) counterKey() string {
+	fields := strings.Fields(r.Format())
+
+	table := "filter"
+	options := []string{}
+	for i := 1; i < len(fields); i++ {
+		if fields[i] == "-t" && i+1 < len(fields) {
+			table = fields[i+1]
+			i++
+			continue
+		}
+		options = append(options, fields[i])
+	}
+	return counterKey(table, fields[0], options)
+}
+
+// parse 'iptables-save -c' output, adding the counters of each line to the matching recorded rules
+func readCounters(table string, counters map[string][]*ruleCounter) error {
+	exitCode, stdo, stde, err := externalRun(IPTABLES_SAVE_BINARY, "-c -t "+table, false)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		fmt.Fprintln(os.Stderr, stde)
+		return errors.New("cannot read counters of table " + table)
+	}
+
+	for _, line := range strings.Split(stdo, "\n") {
+		// e.g. '[12:720] -A FORWARD -s 1.2.3.4/32 ... -j DOCKER'
+		if !strings.HasPrefix(line, "[") {
+			continue
+		}
+		end := strings.Index(line, "]")
+		if end == -1 {
+			continue
+		}
+		values := strings.SplitN(line[1:end], ":", 2)
+		if len(values) != 2 {
+			continue
+		}
+		packets, err := strconv.ParseUint(values[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		bytes, err := strconv.ParseUint(values[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		fields := strings.Fields(line[end+1:])
+		if len(fields) < 2 || fields[0] != "-A" {
+			continue
+		}
+
+		for _, rc := range counters[counterKey(table, fields[1], fields[2:])] {
+			rc.Packets += packets
+			rc.Bytes += bytes
+			rc.Present = true
+		}
+	}
+	return nil
+}
+
+// collect counters of all rules recorded for the specified containers (all containers if none specified)
+func CollectCounters(containerIds []string) ([]*ruleCounter, error) {
+	containers := []*docker.Container{}
+	if len(containerIds) == 0 {
+		err := ccl.LoadAllContainers()
+		if err != nil {
+			return nil, err
+		}
+		containers = ccl.GetAllContainers()
+		sort.Sort(byName(containers))
+	} else {
+		for _, cid := range containerIds {
+			container, err := ccl.LookupContainer(cid)
+			if err != nil {
+				return nil, err
+			}
+			containers = append(containers, container)
+		}
+	}
+
+	result := []*ruleCounter{}
+	counters := map[string][]*ruleCounter{}
+	tables := map[string]bool{"filter": true}
+	for _, container := range containers {
+		c, err := LoadRules(container)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range c.Rules {
+			rc := &ruleCounter{Container: container.Name[1:], Rule: r}
+			key := r.counterKey()
+			counters[key] = append(counters[key], rc)
+			result = append(result, rc)
+
+			if r.Table != "" {
+				tables[r.Table] = true
+			}
+		}
+	}
+
+	for table := range tables {
+		err := readCounters(table, counters)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// write counters in Prometheus text format; rules with the same labels are summed up
+func writeMetrics(w io.Writer, counters []*ruleCounter) {
+	type sample struct {
+		labels         string
+		packets, bytes uint64
+	}
+	samples := map[string]*sample{}
+	keys := []string{}
+	for _, rc := range counters {
+		labels := fmt.Sprintf(`container="%s",chain="%s",peer="%s",port="%s",protocol="%s"`,
+			escapeLabelValue(rc.Container), escapeLabelValue(rc.Rule.Chain), escapeLabelValue(rc.Peer()), rc.Port(), escapeLabelValue(rc.Rule.Protocol))
+		s, ok := samples[labels]
+		if !ok {
+			s = &sample{labels: labels}
+			samples[labels] = s
+			keys = append(keys, labels)
+		}
+		s.packets += rc.Packets
+		s.bytes += rc.Bytes
+	}
+
+	fmt.Fprintln(w, "# HELP docker_fw_rule_packets_total Packets matched by rules recorded by docker-fw.")
+	fmt.Fprintln(w, "# TYPE docker_fw_rule_packets_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "docker_fw_rule_packets_total{%s} %d\n", key, samples[key].packets)
+	}
+	fmt.Fprintln(w, "# HELP docker_fw_rule_bytes_total Bytes matched by rules recorded by docker-fw.")
+	fmt.Fprintln(w, "# TYPE docker_fw_rule_bytes_total counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "docker_fw_rule_bytes_total{%s} %d\n", key, samples[key].bytes)
+	}
+
+	missing := 0
+	for _, rc := range counters {
+		if !rc.Present {
+			missing++
+		}
+	}
+	fmt.Fprintln(w, "# HELP docker_fw_rules_missing Rules recorded by docker-fw that are not present in iptables.")
+	fmt.Fprintln(w, "# TYPE docker_fw_rules_missing gauge")
+	fmt.Fprintf(w, "docker_fw_rules_missing %d\n", missing)
+}
+
+// serialises scrapes, since the containers cache is reset and filled again by each of them
+var metricsMutex sync.Mutex
+
+// corresponding to a subcommand ('metrics')
+// serve counters of all rules as Prometheus metrics, read again at each scrape
+func ServeMetrics(address string) error {
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		metricsMutex.Lock()
+		defer metricsMutex.Unlock()
+
+		// containers might have changed since last scrape
+		resetContainerCache()
+
+		counters, err := CollectCounters(nil)
+		if err != nil {
+			log.Printf("metrics: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, counters)
+	})
+
+	log.Printf("metrics: listening on %s", address)
+	return http.ListenAndServe(address, nil)
+}
+
+// corresponding to a subcommand ('stats')
+// display counters of all rules of the specified containers as a table
+func ShowStats(containerIds []string) error {
+	counters, err := CollectCounters(containerIds)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER\tCHAIN\tPEER\tPORT\tPROTOCOL\tPACKETS\tBYTES\tACTION")
+	for _, rc := range counters {
+		packets := strconv.FormatUint(rc.Packets, 10)
+		if !rc.Present {
+			packets = "missing"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n", rc.Container, rc.Rule.Chain, rc.Peer(), rc.Port(), rc.Rule.Protocol, packets, rc.Bytes, rc.Rule.ExtrapolateAction())
+	}
+	return w.Flush()
+}
@@ -0,0 +1,160 @@
+/*
+ * docker-fw v0.2.4 - a complementary tool for Docker to manage custom
+ *                    firewall rules between/towards Docker containers
+ * Copyright (C) 2014~2016 gdm85 - https://github.com/gdm85/docker-fw/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	LABEL_READY         = LABEL_PREFIX + "ready"
+	LABEL_READY_TIMEOUT = LABEL_PREFIX + "ready-timeout"
+
+	DEFAULT_WAIT_TIMEOUT = time.Minute
+	READY_POLL_INTERVAL  = time.Second
+	READY_DIAL_TIMEOUT   = time.Second
+)
+
+// how readiness of a container is checked
+type readyProbe struct {
+	Command string // 'cmd:' probe, run inside container with 'sh -c'
+	Port    int    // 'tcp:' probe, connected to on container address
+}
+
+// parse the ready label of container, if any
+func parseReadyProbe(container *docker.Container) (*readyProbe, error) {
+	if container.Config == nil {
+		return nil, nil
+	}
+	value, ok := container.Config.Labels[LABEL_READY]
+	if !ok {
+		return nil, nil
+	}
+
+	switch {
+	case strings.HasPrefix(value, "cmd:") && strings.TrimSpace(value[len("cmd:"):]) != "":
+		return &readyProbe{Command: value[len("cmd:"):]}, nil
+	case strings.HasPrefix(value, "tcp:"):
+		port, err := strconv.ParseUint(value[len("tcp:"):], 10, 16)
+		if err == nil && port != 0 {
+			return &readyProbe{Port: int(port)}, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("label %s of container '%s': must be either 'cmd:command' or 'tcp:port'", LABEL_READY, container.Name[1:]))
+}
+
+// timeout for container to be ready, as specified in its ready-timeout label
+func readyTimeout(container *docker.Container, defaultTimeout time.Duration) (time.Duration, error) {
+	if container.Config == nil {
+		return defaultTimeout, nil
+	}
+	value, ok := container.Config.Labels[LABEL_READY_TIMEOUT]
+	if !ok {
+		return defaultTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, errors.New(fmt.Sprintf("label %s of container '%s': not a valid duration '%s'", LABEL_READY_TIMEOUT, container.Name[1:], value))
+	}
+	return timeout, nil
+}
+
+// check once if container is ready: through its health check if it has one, otherwise through the probe of its ready label;
+// a running container without either is always ready. The returned error explains why container is not ready
+func checkReady(container *docker.Container, probe *readyProbe) error {
+	if container.State.Health.Status != "" {
+		if container.State.Health.Status != "healthy" {
+			return errors.New("health status is " + container.State.Health.Status)
+		}
+		return nil
+	}
+
+	if probe == nil {
+		return nil
+	}
+
+	if probe.Command != "" {
+		result, err := containerExec(container.ID, []string{"sh", "-c", probe.Command})
+		if err != nil {
+			return err
+		}
+		if result.ExitCode != 0 {
+			return errors.New(fmt.Sprintf("probe command exited with %d: %s", result.ExitCode, strings.TrimSpace(result.Stderr)))
+		}
+		return nil
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(container.NetworkSettings.IPAddress, strconv.Itoa(probe.Port)), READY_DIAL_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	_ = conn.Close()
+	return nil
+}
+
+// block until the container of node is ready, or fail after its timeout; containers are inspected directly
+// instead of going through the containers cache, since this is called while other containers are being started
+func waitReady(node *Node, defaultTimeout time.Duration) error {
+	container, err := Docker.InspectContainer(node.ID)
+	if err != nil {
+		return err
+	}
+
+	probe, err := parseReadyProbe(container)
+	if err != nil {
+		return err
+	}
+	timeout, err := readyTimeout(container, defaultTimeout)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		// a container that exited will never be ready
+		if !container.State.Running {
+			return errors.New(fmt.Sprintf("container '%s' is not running (exit code %d), cannot be ready", node.Name, container.State.ExitCode))
+		}
+
+		err = checkReady(container, probe)
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return errors.New(fmt.Sprintf("container '%s' not ready after %s: %s", node.Name, timeout, err))
+		}
+		time.Sleep(READY_POLL_INTERVAL)
+
+		container, err = Docker.InspectContainer(node.ID)
+		if err != nil {
+			return err
+		}
+	}
+}
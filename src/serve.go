@@ -0,0 +1,491 @@
+/*
+ * docker-fw v0.2.4 - a complementary tool for Docker to manage custom
+ *                    firewall rules between/towards Docker containers
+ * Copyright (C) 2014~2016 gdm85 - https://github.com/gdm85/docker-fw/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// response of all API requests
+type apiResponse struct {
+	ExitCode int         `json:"exitCode"`
+	Error    string      `json:"error,omitempty"`
+	Data     interface{} `json:"data,omitempty"`
+}
+
+// an invalid request, reported with status 400
+type apiBadRequest struct {
+	err error
+}
+
+func (e *apiBadRequest) Error() string {
+	return e.err.Error()
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &apiBadRequest{errors.New(fmt.Sprintf(format, args...))}
+}
+
+// a request handler returns the exit code the corresponding CLI action would have
+type apiFunc func(r *http.Request) (int, interface{}, error)
+
+type apiListedContainer struct {
+	Id       string
+	Name     string
+	Commands []string // same output of 'ls' action
+	*IptablesRulesCollection
+}
+
+type apiAddRequest struct {
+	Action     string
+	Container  string
+	Source     string
+	SourcePort uint16
+	Dest       string
+	DestPort   uint16
+	Protocol   string
+	Filter     string
+	TTL        string
+	Expires    string
+}
+
+type apiAllowRequest struct {
+	Container string
+	Addresses []string
+	IpSet     bool
+	Ports     string
+	TTL       string
+	Expires   string
+}
+
+type apiRevokeRequest struct {
+	Container string
+	Addresses []string
+	DryRun    bool
+}
+
+// data of responses to dry-run requests
+type apiDryRunOutput struct {
+	Output []string // lines that the corresponding action would print
+}
+
+type apiContainersRequest struct {
+	Containers     []string
+	DryRun         bool
+	Paused         bool // only for 'start'
+	PullDeps       bool // only for 'start'
+	Parallel       int  // only for 'start'
+	Wait           bool // only for 'start'
+	HoldUntilReady bool // only for 'start'
+}
+
+// wrap a request handler: requests are serialised with the CLI through the lock file,
+// the containers cache is reset and panics are reported as internal errors
+func apiHandler(method string, fn apiFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeApiResponse(w, http.StatusMethodNotAllowed, &apiResponse{ExitCode: 1, Error: "method not allowed"})
+			return
+		}
+
+		lock, err := acquireLock()
+		if err != nil {
+			writeApiResponse(w, http.StatusInternalServerError, &apiResponse{ExitCode: 1, Error: err.Error()})
+			return
+		}
+		defer releaseLock(lock)
+
+		// containers might have changed since last request
+		resetContainerCache()
+
+		defer func() {
+			if p := recover(); p != nil {
+				log.Printf("serve: %s %s: panic: %v", r.Method, r.URL.Path, p)
+				writeApiResponse(w, http.StatusInternalServerError, &apiResponse{ExitCode: 1, Error: fmt.Sprintf("internal error: %v", p)})
+			}
+		}()
+
+		exitCode, data, err := fn(r)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if _, ok := err.(*apiBadRequest); ok {
+				status = http.StatusBadRequest
+			}
+			if exitCode == 0 {
+				exitCode = 1
+			}
+			writeApiResponse(w, status, &apiResponse{ExitCode: exitCode, Error: err.Error(), Data: data})
+			return
+		}
+
+		writeApiResponse(w, http.StatusOK, &apiResponse{ExitCode: exitCode, Data: data})
+	}
+}
+
+func writeApiResponse(w http.ResponseWriter, status int, response *apiResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		log.Printf("serve: cannot write response: %s", err)
+	}
+}
+
+// run fn capturing what it prints on standard output, e.g. the commands of dry-run actions;
+// requests are serialised, thus standard output can be redirected for the duration of fn
+func captureOutput(fn func() (int, error)) (int, *apiDryRunOutput, error) {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return 1, nil, err
+	}
+
+	captured := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(pr)
+		_ = pr.Close()
+		captured <- b
+	}()
+
+	stdout := os.Stdout
+	os.Stdout = pw
+	exitCode, err := func() (int, error) {
+		// restore standard output also on panic
+		defer func() {
+			os.Stdout = stdout
+			_ = pw.Close()
+		}()
+		return fn()
+	}()
+
+	output := &apiDryRunOutput{Output: []string{}}
+	text := strings.TrimRight(string(<-captured), "\n")
+	if text != "" {
+		output.Output = strings.Split(text, "\n")
+	}
+	return exitCode, output, err
+}
+
+func decodeRequest(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		return badRequest("invalid request body: %s", err)
+	}
+	return nil
+}
+
+func validateContainerIds(containerIds []string) error {
+	if len(containerIds) == 0 {
+		return badRequest("no containers specified")
+	}
+	for _, cid := range containerIds {
+		if !containerIdMatch.MatchString(cid) {
+			return badRequest("not a valid container id: %s", cid)
+		}
+	}
+	return nil
+}
+
+// GET /rules[?container=id...]
+func apiListRules(r *http.Request) (int, interface{}, error) {
+	containerIds := r.URL.Query()["container"]
+
+	containers := []*docker.Container{}
+	if len(containerIds) == 0 {
+		err := ccl.LoadAllContainers()
+		if err != nil {
+			return 1, nil, err
+		}
+		containers = ccl.GetAllContainers()
+	} else {
+		for _, cid := range containerIds {
+			container, err := ccl.LookupContainer(cid)
+			if err != nil {
+				return 1, nil, err
+			}
+			containers = append(containers, container)
+		}
+	}
+
+	listed := []*apiListedContainer{}
+	for _, container := range containers {
+		collection, err := LoadRules(container)
+		if err != nil {
+			return 2, nil, err
+		}
+		listed = append(listed, &apiListedContainer{
+			Id:                      container.ID,
+			Name:                    container.Name[1:],
+			Commands:                collection.FormatAsFwCommands(container.Name[1:]),
+			IptablesRulesCollection: collection,
+		})
+	}
+	return 0, listed, nil
+}
+
+// POST /rules, same as the add actions
+func apiAddRule(r *http.Request) (int, interface{}, error) {
+	var req apiAddRequest
+	err := decodeRequest(r, &req)
+	if err != nil {
+		return 1, nil, err
+	}
+
+	switch req.Action {
+	case "add", "add-input", "add-two-ways", "add-internal", "add-egress":
+	default:
+		return 1, nil, badRequest("not a valid add action: %s", req.Action)
+	}
+	err = validateContainerIds([]string{req.Container})
+	if err != nil {
+		return 1, nil, err
+	}
+
+	// build the same command line accepted by the CLI
+	args := []string{os.Args[0]}
+	for _, opt := range []struct{ name, value string }{
+		{"source", req.Source}, {"dest", req.Dest}, {"protocol", req.Protocol},
+		{"filter", req.Filter}, {"ttl", req.TTL}, {"expires", req.Expires},
+	} {
+		if opt.value != "" {
+			args = append(args, fmt.Sprintf("--%s=%s", opt.name, opt.value))
+		}
+	}
+	if req.SourcePort != 0 {
+		args = append(args, fmt.Sprintf("--sport=%d", req.SourcePort))
+	}
+	if req.DestPort != 0 {
+		args = append(args, fmt.Sprintf("--dport=%d", req.DestPort))
+	}
+
+	commandLine := NewAction(false)
+	commandLine.ContainerId = req.Container
+	err = commandLine.Parse(args)
+	if err != nil {
+		return 1, nil, badRequest("%s", err)
+	}
+
+	err = commandLine.Validate(req.Action)
+	if err != nil {
+		return 1, nil, &apiBadRequest{err}
+	}
+
+	err = commandLine.ExecuteAddAction(req.Action)
+	if err != nil {
+		return 2, nil, err
+	}
+	return 0, nil, nil
+}
+
+// DELETE /rules?container=id..., same as 'drop' action
+func apiDropRules(r *http.Request) (int, interface{}, error) {
+	containerIds := r.URL.Query()["container"]
+	err := validateContainerIds(containerIds)
+	if err != nil {
+		return 1, nil, err
+	}
+
+	err = DropRules(containerIds)
+	if err != nil {
+		return 2, nil, err
+	}
+	return 0, nil, nil
+}
+
+// POST /allow
+func apiAllow(r *http.Request) (int, interface{}, error) {
+	var req apiAllowRequest
+	err := decodeRequest(r, &req)
+	if err != nil {
+		return 1, nil, err
+	}
+	err = validateContainerIds([]string{req.Container})
+	if err != nil {
+		return 1, nil, err
+	}
+	if len(req.Addresses) == 0 {
+		return 1, nil, badRequest("no whitelist addresses specified")
+	}
+
+	opts := AllowOptions{IpSet: req.IpSet}
+	opts.Expires, err = parseExpiry(req.TTL, req.Expires)
+	if err != nil {
+		return 1, nil, &apiBadRequest{err}
+	}
+	if req.Ports != "" {
+		opts.Ports, err = parseAllowedPorts(req.Ports)
+		if err != nil {
+			return 1, nil, &apiBadRequest{err}
+		}
+	}
+
+	err = AllowExternal(req.Container, req.Addresses, &opts)
+	if err != nil {
+		return 2, nil, err
+	}
+	return 0, nil, nil
+}
+
+// POST /revoke
+func apiRevoke(r *http.Request) (int, interface{}, error) {
+	var req apiRevokeRequest
+	err := decodeRequest(r, &req)
+	if err != nil {
+		return 1, nil, err
+	}
+	err = validateContainerIds([]string{req.Container})
+	if err != nil {
+		return 1, nil, err
+	}
+	if len(req.Addresses) == 0 {
+		return 1, nil, badRequest("no addresses specified")
+	}
+
+	if req.DryRun {
+		return captureOutput(func() (int, error) {
+			return RevokeExternal(req.Container, req.Addresses, true)
+		})
+	}
+	exitCode, err := RevokeExternal(req.Container, req.Addresses, false)
+	return exitCode, nil, err
+}
+
+// POST /replay
+func apiReplay(r *http.Request) (int, interface{}, error) {
+	var req apiContainersRequest
+	err := decodeRequest(r, &req)
+	if err != nil {
+		return 1, nil, err
+	}
+	err = validateContainerIds(req.Containers)
+	if err != nil {
+		return 1, nil, err
+	}
+
+	if req.DryRun {
+		return captureOutput(func() (int, error) {
+			return ReplayRules(req.Containers, true)
+		})
+	}
+	exitCode, err := ReplayRules(req.Containers, false)
+	return exitCode, nil, err
+}
+
+// POST /start
+func apiStart(r *http.Request) (int, interface{}, error) {
+	var req apiContainersRequest
+	err := decodeRequest(r, &req)
+	if err != nil {
+		return 1, nil, err
+	}
+	err = validateContainerIds(req.Containers)
+	if err != nil {
+		return 1, nil, err
+	}
+	if req.Wait && (req.Paused || req.HoldUntilReady) {
+		return 1, nil, badRequest("paused containers cannot become ready")
+	}
+	if req.Paused && req.HoldUntilReady {
+		return 1, nil, badRequest("Paused and HoldUntilReady cannot be used together")
+	}
+
+	opts := &StartOptions{Paused: req.Paused, PullDeps: req.PullDeps, DryRun: req.DryRun, Parallel: req.Parallel, Wait: req.Wait, WaitTimeout: DEFAULT_WAIT_TIMEOUT, HoldUntilReady: req.HoldUntilReady}
+	if req.DryRun {
+		return captureOutput(func() (int, error) {
+			return StartContainers(req.Containers, opts)
+		})
+	}
+	exitCode, err := StartContainers(req.Containers, opts)
+	return exitCode, nil, err
+}
+
+// corresponding to a subcommand ('serve')
+// expose an HTTP/JSON API on a unix socket, until interrupted
+func Serve(socketPath string) error {
+	// remove a stale socket left behind by a previous instance
+	if fi, err := os.Stat(socketPath); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(socketPath)
+	}
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socketPath)
+
+	err = os.Chmod(socketPath, 0660)
+	if err != nil {
+		_ = listener.Close()
+		return err
+	}
+
+	rules := map[string]apiFunc{
+		"GET":    apiListRules,
+		"POST":   apiAddRule,
+		"DELETE": apiDropRules,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rules", func(w http.ResponseWriter, r *http.Request) {
+		fn, ok := rules[r.Method]
+		if !ok {
+			writeApiResponse(w, http.StatusMethodNotAllowed, &apiResponse{ExitCode: 1, Error: "method not allowed"})
+			return
+		}
+		apiHandler(r.Method, fn)(w, r)
+	})
+	mux.HandleFunc("/allow", apiHandler("POST", apiAllow))
+	mux.HandleFunc("/revoke", apiHandler("POST", apiRevoke))
+	mux.HandleFunc("/replay", apiHandler("POST", apiReplay))
+	mux.HandleFunc("/start", apiHandler("POST", apiStart))
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupted)
+	stopped := make(chan struct{})
+	go func() {
+		<-interrupted
+		close(stopped)
+		_ = listener.Close()
+	}()
+
+	log.Printf("serve: listening on %s", socketPath)
+	err = http.Serve(listener, mux)
+
+	select {
+	case <-stopped:
+		// listener closed on interruption
+		return nil
+	default:
+		return err
+	}
+}
@@ -25,6 +25,8 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/fsouza/go-dockerclient"
 )
@@ -40,7 +42,7 @@ func arrayContains(haystack []*docker.Container, needle *docker.Container) bool
 }
 
 // this fix is necessary for an undocumented bug: you cannot feed back to API what you got it from regarding Links
-func fixHostConfig(name string, orig *docker.HostConfig) {
+func fixHostConfig(name string, orig *docker.HostConfig) error {
 	// normalize
 	if orig.RestartPolicy.Name == "" {
 		orig.RestartPolicy = docker.NeverRestart()
@@ -54,7 +56,7 @@ func fixHostConfig(name string, orig *docker.HostConfig) {
 		// remove prefix from second part and leading slash from first part
 		if parts[0][0] != '/' || parts[1][0] != '/' {
 			// something has changed in API, likely inconsistency fixed upstream
-			panic("unexpected format of links")
+			return errors.New(fmt.Sprintf("unexpected format of links: %s", link))
 		}
 		parts[0] = parts[0][1:]
 		parts[1] = parts[1][(len(name) + 1):]
@@ -63,6 +65,7 @@ func fixHostConfig(name string, orig *docker.HostConfig) {
 
 	// replace new links
 	orig.Links = newLinks
+	return nil
 }
 
 func startAndSave(container *docker.Container) error {
@@ -78,30 +81,42 @@ func startAndSave(container *docker.Container) error {
 		hostConfig = container.HostConfig
 	}
 
-	fixHostConfig(container.Name, hostConfig)
-
-	// use last known host configuration
-	err = Docker.StartContainer(container.ID, hostConfig)
+	err = fixHostConfig(container.Name, hostConfig)
 	if err != nil {
 		return err
 	}
 
-	// this will also enforce container to be online
-	err = ccl.RefreshContainer(container.ID, true)
+	// use last known host configuration
+	return Docker.StartContainer(container.ID, hostConfig)
+}
 
-	return err
+type StartOptions struct {
+	Paused   bool // start containers in paused status
+	PullDeps bool // add dependencies to selection
+	DryRun   bool
+	Parallel int // maximum number of containers started at the same time
+	// wait for containers to be ready before starting the containers depending on them
+	Wait        bool
+	WaitTimeout time.Duration // unless specified by the container ready-timeout label
+	// start containers paused and unpause them only once rules and custom hosts of all of them are in place
+	HoldUntilReady bool
 }
 
-func StartContainers(containerIds []string, startPaused, pullDeps, dryRun bool) (int, error) {
-	normalizedIds, err := internalStartContainers(containerIds, startPaused, pullDeps, dryRun)
+// serialises access to containers cache and iptables between containers started in parallel
+var startMutex sync.Mutex
+
+func StartContainers(containerIds []string, opts *StartOptions) (int, error) {
+	normalizedIds, held, err := internalStartContainers(containerIds, opts)
 	if err != nil {
-		return 127, err
+		warnHeld(held)
+		return graphFailure(err)
 	}
 
 	// restore custom hosts modifications
 	for _, id := range normalizedIds {
 		err = reapplyCustomHosts(id)
 		if err != nil {
+			warnHeld(held)
 			return 128, err
 		}
 	}
@@ -111,158 +126,221 @@ func StartContainers(containerIds []string, startPaused, pullDeps, dryRun bool)
 		return 0, nil
 	}
 
-	// at the end, always run the 'replay' action
-	return ReplayRules(normalizedIds, dryRun)
+	// at the end, always run the 'replay' action, also for rules that could not be replayed as containers were started
+	exitCode, err := ReplayRules(normalizedIds, opts.DryRun)
+	if err != nil {
+		warnHeld(held)
+		return exitCode, err
+	}
+
+	// firewall of the whole group is in place, containers can now run
+	for i, node := range held {
+		err = Docker.UnpauseContainer(node.ID)
+		if err != nil {
+			warnHeld(held[i:])
+			return 130, err
+		}
+	}
+
+	return exitCode, nil
+}
+
+// report containers that were left paused because of a failure
+func warnHeld(held []*Node) {
+	if len(held) == 0 {
+		return
+	}
+
+	names := []string{}
+	for _, node := range held {
+		names = append(names, node.Name)
+	}
+	log.Printf("WARNING: containers left paused: %s", strings.Join(names, ", "))
+}
+
+// exit code for a failure while ordering or starting/stopping containers
+// the cycle of a CycleError is part of its message, thus it is reported only once by the caller
+func graphFailure(err error) (int, error) {
+	if _, ok := err.(*CycleError); ok {
+		return 129, err
+	}
+	return 127, err
 }
 
 // 1) build a graph of container dependencies
-// 2) start them from lowest to highest dependency count
-// 3) for each container start, pause them (if asked to)
-// 4) when all containers have been started, run the 'replay' action for them
-func internalStartContainers(containerIds []string, startPaused, pullDeps, dryRun bool) ([]string, error) {
+// 2) group them in levels, from lowest to highest dependency count
+// 3) start containers of each level, up to the specified number in parallel, and pause them (if asked to)
+// 4) as each container is started, run the 'replay' action for it and restore its custom hosts
+// 5) if asked to, wait for containers with dependents to be ready before starting next level
+// containers that were started paused to hold them until the whole group is ready are returned in dependency order
+func internalStartContainers(containerIds []string, opts *StartOptions) ([]string, []*Node, error) {
 	// first normalize all container ids to the proper 'ID' property given through inspect
 	// this is necessary because we won't allow to start dependant containers if not specified
 	var containers []*docker.Container
+	var held []*Node
 	normalizedIds := []string{}
 	for _, cid := range containerIds {
 		container, err := ccl.LookupContainer(cid)
 		if err != nil {
-			return normalizedIds, err
+			return normalizedIds, held, err
 		}
 
 		containers = append(containers, container)
 		normalizedIds = append(normalizedIds, container.ID)
 	}
 
-	// build the sortable graph of nodes and their link dependencies
-	lookup := map[string]*Node{}
-	for _, container := range containers {
+	// build the sortable graph of nodes and their dependencies
+	allNodes, err := BuildDependencyGraph(containers, opts.PullDeps, false)
+	if err != nil {
+		return normalizedIds, held, err
+	}
 
-		// prepare container node itself
-		node, ok := lookup[container.ID]
-		if !ok {
-			node = NewNode(container)
-			lookup[container.ID] = node
-		}
+	// apply topological sort
+	levels, err := allNodes.TopSortLevels()
+	if err != nil {
+		return normalizedIds, held, err
+	}
 
-		for _, link := range container.HostConfig.Links {
-			parts := strings.SplitN(link, ":", 2)
+	parallel := opts.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
 
-			// identify the target container
-			linkName := parts[0][1:]
-			linkContainer, err := ccl.LookupContainer(linkName)
-			if err != nil {
-				return normalizedIds, err
+	for _, level := range levels {
+		if opts.DryRun {
+			for _, node := range level {
+				fmt.Println(node.Name)
 			}
+			continue
+		}
 
-			// error if a container is missing from selection and no --pull-deps was specified
-			if !pullDeps {
-				if !arrayContains(containers, linkContainer) {
-					return normalizedIds, errors.New(fmt.Sprintf("container '%s' is not specified in list and no --pull-deps specified", linkName))
+		// next level is started only once all containers of this level are up
+		errs := make([]error, len(level))
+		levelHeld := make([]bool, len(level))
+		slots := make(chan bool, parallel)
+		var wg sync.WaitGroup
+		for i, node := range level {
+			wg.Add(1)
+			slots <- true
+			go func(i int, node *Node) {
+				defer wg.Done()
+				defer func() {
+					<-slots
+				}()
+				// a panic would otherwise terminate the whole process, e.g. when serving API requests
+				defer func() {
+					if p := recover(); p != nil {
+						errs[i] = errors.New(fmt.Sprintf("%s: %v", node.Name, p))
+					}
+				}()
+
+				levelHeld[i], errs[i] = startNode(node, opts, inArray(normalizedIds, node.ID))
+				if errs[i] == nil && opts.Wait && len(node.children) > 0 {
+					errs[i] = waitReady(node, opts.WaitTimeout)
 				}
-			}
-
-			linkNode, ok := lookup[linkContainer.ID]
-			if !ok {
-				linkNode = NewNode(linkContainer)
+			}(i, node)
+		}
+		wg.Wait()
 
-				lookup[linkContainer.ID] = linkNode
+		for i, node := range level {
+			if levelHeld[i] {
+				held = append(held, node)
 			}
-
-			// now create association
-			linkNode.LinkTo(node)
 		}
-
-		// now also check dependencies created by volumes
-		for _, volumesProvider := range container.HostConfig.VolumesFrom {
-
-			// identify the provider container
-			volsContainer, err := ccl.LookupContainer(volumesProvider)
+		for _, err := range errs {
 			if err != nil {
-				return normalizedIds, err
-			}
-
-			// error if a container is missing from selection and no --pull-deps was specified
-			if !pullDeps {
-				if !arrayContains(containers, volsContainer) {
-					return normalizedIds, errors.New(fmt.Sprintf("container '%s' (volumes provider) is not specified in list and no --pull-deps specified", volsContainer.Name[1:]))
-				}
+				return normalizedIds, held, err
 			}
-
-			volsNode, ok := lookup[volsContainer.ID]
-			if !ok {
-				volsNode = NewNode(volsContainer)
-
-				lookup[volsContainer.ID] = volsNode
-			}
-
-			// now create association
-			volsNode.LinkTo(node)
 		}
 	}
 
-	// convert the map to a flat array
-	var allNodes SortableNodeArray
-	for _, v := range lookup {
-		allNodes = append(allNodes, v)
+	if !opts.DryRun {
+		// attempt to save again network rules
+		// NOTE: will fail if any change is detected
+		err := BackupHostConfig(normalizedIds, true, true)
+		if err != nil {
+			return normalizedIds, held, err
+		}
 	}
 
-	// apply topological sort
-	allNodes = allNodes.TopSort()
+	return normalizedIds, held, nil
+}
 
-	for _, node := range allNodes {
-		// print container names as they are started, Docker-style
-		fmt.Println(node.Name)
+// start (and pause, if asked to) the container of node, then replay its rules and custom hosts if it is part of selection;
+// calls to Docker API are the only operations performed without holding startMutex; returns true if the container
+// was started paused to hold it until the whole group is ready
+func startNode(node *Node, opts *StartOptions, replay bool) (bool, error) {
+	// always get latest version, since state might have changed
+	startMutex.Lock()
+	container, err := ccl.LookupContainer(node.ID)
+	startMutex.Unlock()
+	if err != nil {
+		return false, err
+	}
 
-		if dryRun {
-			continue
+	changedState := false
+	held := false
+	// start container
+	if !container.State.Running {
+		err := startAndSave(container)
+		if err == nil && opts.HoldUntilReady {
+			// pause as soon as possible, before its firewall is in place the container should not run
+			err = Docker.PauseContainer(container.ID)
+			if err != nil {
+				// do not leave it running without its firewall
+				stopErr := Docker.StopContainer(container.ID, DEFAULT_STOP_TIMEOUT)
+				if stopErr != nil {
+					err = errors.New(fmt.Sprintf("cannot pause container '%s' (%s), and cannot stop it either: %s", node.Name, err, stopErr))
+				} else {
+					err = errors.New(fmt.Sprintf("cannot pause container '%s', it has been stopped: %s", node.Name, err))
+				}
+			}
+			held = err == nil
 		}
-
-		// always get latest version, since state might have changed
-		container, err := ccl.LookupContainer(node.ID)
 		if err != nil {
-			return normalizedIds, err
+			return held, err
 		}
+		changedState = true
 
-		changedState := false
-		// start container
-		if !container.State.Running {
-			err := startAndSave(container)
-			if err != nil {
-				return normalizedIds, err
-			}
-			changedState = true
+		//NOTE: container's paused status has not changed because of start
+	}
 
-			//NOTE: container's paused status has not changed because of start
+	if opts.Paused && !container.State.Paused && !held {
+		//NOTE: container might already have been paused in command above
+		err := Docker.PauseContainer(container.ID)
+		if err != nil {
+			return held, err
 		}
+		changedState = true
+	}
 
-		if startPaused && !container.State.Paused {
-			//NOTE: container might already have been paused in command above
-			err := Docker.PauseContainer(container.ID)
-			if err != nil {
-				return normalizedIds, err
-			}
-			changedState = true
-		}
+	startMutex.Lock()
+	defer startMutex.Unlock()
 
-		if changedState {
-			// always get latest version, since state might have changed
-			// this will also enforce container to be online
-			err = ccl.RefreshContainer(container.ID, true)
-			if err != nil {
-				return normalizedIds, err
-			}
+	// print container names as they are started, Docker-style
+	fmt.Println(node.Name)
+
+	if changedState {
+		// always get latest version, since state might have changed
+		// this will also enforce container to be online
+		err = ccl.RefreshContainer(container.ID, true)
+		if err != nil {
+			return held, err
 		}
 	}
 
-	if !dryRun {
-		// attempt to save again network rules
-		// NOTE: will fail if any change is detected
-		err := BackupHostConfig(normalizedIds, true, true)
+	if replay {
+		// rules and hosts referencing containers that are not yet started will be applied at the end
+		exitCode, err := ReplayRules([]string{container.ID}, false)
+		if err != nil {
+			log.Printf("WARNING: replay of container '%s' deferred (exit code %d): %s", node.Name, exitCode, err)
+		}
+
+		err = reapplyCustomHosts(container.ID)
 		if err != nil {
-			return normalizedIds, err
+			log.Printf("WARNING: restore of custom hosts of container '%s' deferred: %s", node.Name, err)
 		}
 	}
 
-	return normalizedIds, nil
+	return held, nil
 }
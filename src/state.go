@@ -32,8 +32,11 @@ import (
 	"github.com/fsouza/go-dockerclient"
 )
 
+// directory of Docker containers, where state files are kept together with the ones of Docker
+var containersDir = "/var/lib/docker/containers"
+
 func getBackupHostConfigFileName(cid string) string {
-	return fmt.Sprintf("/var/lib/docker/containers/%s/backupHostConfig.json", cid)
+	return fmt.Sprintf("%s/%s/backupHostConfig.json", containersDir, cid)
 }
 
 //NOTE: container must be running in order for this to be working
@@ -170,7 +173,7 @@ func LoadRules(container *docker.Container) (*IptablesRulesCollection, error) {
 }
 
 func getCustomHostsFileName(c *docker.Container) string {
-	return fmt.Sprintf("/var/lib/docker/containers/%s/customHosts.json", c.ID)
+	return fmt.Sprintf("%s/%s/customHosts.json", containersDir, c.ID)
 }
 
 func LoadCustomHosts(container *docker.Container) ([]string, error) {
@@ -288,13 +291,31 @@ func restorePaused(c *docker.Container, paused bool, origErr error) error {
 }
 
 func updateHosts(c *docker.Container, ch []string) error {
+	// a paused container cannot exec, but its hosts file is bind-mounted from the host and can be modified directly
+	// in place (without replacing it), thus a container started paused never runs before its hosts are updated
+	if c.State.Paused && c.HostsPath != "" {
+		bytes, err := ioutil.ReadFile(c.HostsPath)
+		if err != nil {
+			return err
+		}
+
+		content, hasHostsChanges, err := rewriteHosts(c, string(bytes), ch)
+		if err != nil {
+			return err
+		}
+
+		if hasHostsChanges {
+			return ioutil.WriteFile(c.HostsPath, []byte(content), 0644)
+		}
+		return nil
+	}
+
 	// In order to exec successfully within the container, we must unpause it if it were paused
 	// although nsenter has not such limitation, for some reason it is enforced by Docker,
 	// thus here docker-fw complies by first unpausing the container and then re-pausing it.
 	// The net result is that - whatsoever your experiments tell you - you should never relay on two-ways containers
 	// being reachable during any of your initialization in CMD/ENTRYPOINT commands.
-	// This could be better handled by directly modifying the hosts file even before container is started,
-	// but it would be using undocumented features.
+	// This happens only when the hosts file path is not known (older Docker versions).
 	wasPaused := false
 	if c.State.Paused {
 		err := Docker.UnpauseContainer(c.ID)
@@ -314,11 +335,30 @@ func updateHosts(c *docker.Container, ch []string) error {
 		return restorePaused(c, wasPaused, err)
 	}
 
+	content, hasHostsChanges, err := rewriteHosts(c, result.Stdout, ch)
+	if err != nil {
+		return restorePaused(c, wasPaused, err)
+	}
+
+	// write new hosts file (as needed)
+	if hasHostsChanges {
+		err := containerInject(c.ID, "/etc/hosts", content)
+		if err != nil {
+			return restorePaused(c, wasPaused, err)
+		}
+	}
+
+	return restorePaused(c, wasPaused, nil)
+}
+
+// rewrite the hosts file content of container c with the current addresses of the custom hosts;
+// the boolean return value is true if there was any change
+func rewriteHosts(c *docker.Container, hosts string, ch []string) (string, bool, error) {
 	// read existing hosts
 	hasHostsChanges := false
 	rewrittenLines := []string{}
 	okContainers := []string{}
-	for _, line := range strings.Split(result.Stdout, "\n") {
+	for _, line := range strings.Split(hosts, "\n") {
 		line = strings.TrimSpace(line)
 
 		if len(line) == 0 || line[0] == '#' {
@@ -334,7 +374,7 @@ func updateHosts(c *docker.Container, ch []string) error {
 		for _, cid := range ch {
 			container, err := ccl.LookupOnlineContainer(cid)
 			if err != nil {
-				return restorePaused(c, wasPaused, err)
+				return "", false, err
 			}
 			for _, field := range fields[1:] {
 				if field == container.Name[1:] {
@@ -380,7 +420,7 @@ func updateHosts(c *docker.Container, ch []string) error {
 	for _, host := range ch {
 		container, err := ccl.LookupOnlineContainer(host)
 		if err != nil {
-			return restorePaused(c, wasPaused, err)
+			return "", false, err
 		}
 		if !inArray(okContainers, container.Name[1:]) {
 			rewrittenLines = append(rewrittenLines, fmt.Sprintf("%s\t%s", container.NetworkSettings.IPAddress, container.Name[1:]))
@@ -389,13 +429,5 @@ func updateHosts(c *docker.Container, ch []string) error {
 		}
 	}
 
-	// write new hosts file (as needed)
-	if hasHostsChanges {
-		err := containerInject(c.ID, "/etc/hosts", strings.Join(rewrittenLines, "\n")+"\n")
-		if err != nil {
-			return restorePaused(c, wasPaused, err)
-		}
-	}
-
-	return restorePaused(c, wasPaused, nil)
+	return strings.Join(rewrittenLines, "\n") + "\n", hasHostsChanges, nil
 }
@@ -0,0 +1,152 @@
+/*
+ * docker-fw v0.2.4 - a complementary tool for Docker to manage custom
+ *                    firewall rules between/towards Docker containers
+ * Copyright (C) 2014~2016 gdm85 - https://github.com/gdm85/docker-fw/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+// seconds to wait for a container to stop before killing it, unless specified
+const DEFAULT_STOP_TIMEOUT = 10
+
+type StopOptions struct {
+	PullDependents bool // add containers depending on the selected ones to selection
+	DryRun         bool
+	Timeout        uint // seconds to wait for each container to stop before killing it
+}
+
+// corresponding to a subcommand ('stop')
+func StopContainers(containerIds []string, opts *StopOptions) (int, error) {
+	_, _, err := internalStopContainers(containerIds, opts)
+	if err != nil {
+		return graphFailure(err)
+	}
+	return 0, nil
+}
+
+// corresponding to a subcommand ('restart')
+// stop containers as 'stop' action does, then start them again as 'start' action does; dependencies that are not part
+// of selection are started if they are not running, while dependents are started again only if they were stopped here
+func RestartContainers(containerIds []string, stopOpts *StopOptions, startOpts *StartOptions) (int, error) {
+	selectedIds, stoppedIds, err := internalStopContainers(containerIds, stopOpts)
+	if err != nil {
+		return graphFailure(err)
+	}
+
+	for _, id := range stoppedIds {
+		if !inArray(selectedIds, id) {
+			selectedIds = append(selectedIds, id)
+		}
+	}
+
+	startOpts.PullDeps = true
+	return StartContainers(selectedIds, startOpts)
+}
+
+// 1) add containers depending on the selected ones (if asked to)
+// 2) build a graph of dependencies among selected containers
+// 3) stop them in reverse order, so that containers are stopped before the containers they depend on
+// returned are the ids of the selected containers (without dependents) and of the containers that were actually
+// stopped (or would be, with dry-run)
+func internalStopContainers(containerIds []string, opts *StopOptions) ([]string, []string, error) {
+	var containers []*docker.Container
+	for _, cid := range containerIds {
+		container, err := ccl.LookupContainer(cid)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if !arrayContains(containers, container) {
+			containers = append(containers, container)
+		}
+	}
+
+	normalizedIds := []string{}
+	for _, container := range containers {
+		normalizedIds = append(normalizedIds, container.ID)
+	}
+
+	if opts.PullDependents {
+		dependents, err := dependentContainers(containers)
+		if err != nil {
+			return normalizedIds, nil, err
+		}
+		containers = append(containers, dependents...)
+	}
+
+	allNodes, err := BuildSelectionGraph(containers, false)
+	if err != nil {
+		return normalizedIds, nil, err
+	}
+
+	// apply topological sort
+	allNodes, err = allNodes.TopSort()
+	if err != nil {
+		return normalizedIds, nil, err
+	}
+
+	stoppedIds := []string{}
+
+	for i := len(allNodes) - 1; i >= 0; i-- {
+		node := allNodes[i]
+
+		// print container names as they are stopped, Docker-style
+		fmt.Println(node.Name)
+
+		// always get latest version, since state might have changed
+		container, err := ccl.LookupContainer(node.ID)
+		if err != nil {
+			return normalizedIds, stoppedIds, err
+		}
+
+		if !container.State.Running {
+			continue
+		}
+
+		if opts.DryRun {
+			stoppedIds = append(stoppedIds, container.ID)
+			continue
+		}
+
+		// Docker does not stop paused containers
+		if container.State.Paused {
+			err = Docker.UnpauseContainer(container.ID)
+			if err != nil {
+				return normalizedIds, stoppedIds, err
+			}
+		}
+
+		err = Docker.StopContainer(container.ID, opts.Timeout)
+		if err != nil {
+			return normalizedIds, stoppedIds, err
+		}
+		stoppedIds = append(stoppedIds, container.ID)
+
+		err = ccl.RefreshContainer(container.ID, false)
+		if err != nil {
+			return normalizedIds, stoppedIds, err
+		}
+	}
+
+	return normalizedIds, stoppedIds, nil
+}
@@ -0,0 +1,200 @@
+/*
+ * docker-fw v0.2.4 - a complementary tool for Docker to manage custom
+ *                    firewall rules between/towards Docker containers
+ * Copyright (C) 2014~2016 gdm85 - https://github.com/gdm85/docker-fw/
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; either version 2
+of the License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+)
+
+const (
+	SYSTEMD_UNITS_DIR     = "/etc/systemd/system"
+	SYSTEMD_TARGET        = "docker-fw.target"
+	SYSTEMD_INIT_UNIT     = "docker-fw-init.service"
+	SYSTEMD_START_UNIT    = "docker-fw-start.service"
+	SYSTEMD_REPLAY_PREFIX = "docker-fw-replay-"
+	SYSTEMD_HEADER        = "# generated by 'docker-fw systemd-generate', changes will be lost when generating again\n"
+)
+
+type systemdUnit struct {
+	Name    string
+	Content string
+}
+
+func replayUnitName(containerName string) string {
+	return SYSTEMD_REPLAY_PREFIX + containerName + ".service"
+}
+
+// absolute path of the running docker-fw binary, used in the generated units
+func selfPath() (string, error) {
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(path)
+}
+
+// generate units for the specified containers (already sorted in dependency order) and the graph of their dependencies:
+//   - the init unit runs 'init --fix' after Docker daemon is started, so that misplaced rules do not fail the boot
+//   - the start unit starts all containers after init
+//   - a replay unit for each container replays its rules after the replay units of its dependencies
+//   - the target wants all of them, and it is the only unit to enable
+func systemdUnits(binary string, sorted SortableNodeArray) []*systemdUnit {
+	header := SYSTEMD_HEADER
+	oneshot := "[Service]\nType=oneshot\nRemainAfterExit=yes\n"
+
+	units := []*systemdUnit{
+		{
+			Name: SYSTEMD_INIT_UNIT,
+			Content: header + "[Unit]\nDescription=docker-fw firewall initialization\nAfter=docker.service\nRequires=docker.service\n\n" +
+				oneshot + fmt.Sprintf("ExecStart=%s init --fix\n", binary),
+		},
+	}
+
+	names := []string{}
+	dependencies := map[string][]string{}
+	for _, node := range sorted {
+		names = append(names, node.Name)
+		for _, child := range node.children {
+			if !inArray(dependencies[child.Name], node.Name) {
+				dependencies[child.Name] = append(dependencies[child.Name], node.Name)
+			}
+		}
+	}
+
+	units = append(units, &systemdUnit{
+		Name: SYSTEMD_START_UNIT,
+		Content: header + fmt.Sprintf("[Unit]\nDescription=docker-fw start of containers\nAfter=%s\nRequires=%s\n\n", SYSTEMD_INIT_UNIT, SYSTEMD_INIT_UNIT) +
+			oneshot + fmt.Sprintf("ExecStart=%s start %s\n", binary, strings.Join(names, " ")),
+	})
+
+	wanted := []string{SYSTEMD_START_UNIT}
+	for _, node := range sorted {
+		required := []string{SYSTEMD_START_UNIT}
+		deps := dependencies[node.Name]
+		sort.Strings(deps)
+		for _, dep := range deps {
+			required = append(required, replayUnitName(dep))
+		}
+
+		units = append(units, &systemdUnit{
+			Name: replayUnitName(node.Name),
+			Content: header + fmt.Sprintf("[Unit]\nDescription=docker-fw replay of rules of container %s\nAfter=%s\nRequires=%s\n\n", node.Name, strings.Join(required, " "), strings.Join(required, " ")) +
+				oneshot + fmt.Sprintf("ExecStart=%s replay %s\n", binary, node.Name),
+		})
+		wanted = append(wanted, replayUnitName(node.Name))
+	}
+
+	units = append(units, &systemdUnit{
+		Name: SYSTEMD_TARGET,
+		Content: header + fmt.Sprintf("[Unit]\nDescription=docker-fw bring-up of containers and their firewall rules\nWants=%s\nAfter=%s\n\n", strings.Join(wanted, " "), strings.Join(wanted, " ")) +
+			"[Install]\nWantedBy=multi-user.target\n",
+	})
+
+	return units
+}
+
+// corresponding to a subcommand ('systemd-generate')
+// write systemd units to bring up the specified containers (all containers if none specified) and their firewall at boot
+func GenerateSystemdUnits(containerIds []string, outputDir string) error {
+	var containers []*docker.Container
+	if len(containerIds) == 0 {
+		err := ccl.LoadAllContainers()
+		if err != nil {
+			return err
+		}
+		containers = ccl.GetAllContainers()
+	} else {
+		for _, cid := range containerIds {
+			container, err := ccl.LookupContainer(cid)
+			if err != nil {
+				return err
+			}
+			containers = append(containers, container)
+		}
+	}
+	if len(containers) == 0 {
+		return errors.New("no containers found")
+	}
+
+	// dependencies are always part of the generated units, as they are needed to start containers
+	allNodes, err := BuildDependencyGraph(containers, true, true)
+	if err != nil {
+		return err
+	}
+	sorted, err := allNodes.TopSort()
+	if err != nil {
+		return err
+	}
+
+	binary, err := selfPath()
+	if err != nil {
+		return err
+	}
+
+	generated := map[string]bool{}
+	for _, unit := range systemdUnits(binary, sorted) {
+		path := filepath.Join(outputDir, unit.Name)
+		err := ioutil.WriteFile(path, []byte(unit.Content), 0644)
+		if err != nil {
+			return err
+		}
+		generated[unit.Name] = true
+		fmt.Printf("docker-fw: wrote %s\n", path)
+	}
+
+	// replay units of containers that are not part of the units anymore, e.g. removed ones
+	paths, err := filepath.Glob(filepath.Join(outputDir, SYSTEMD_REPLAY_PREFIX+"*.service"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if generated[filepath.Base(path)] {
+			continue
+		}
+
+		// never remove units that were not generated
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(string(content), SYSTEMD_HEADER) {
+			continue
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("docker-fw: removed %s\n", path)
+	}
+
+	fmt.Printf("docker-fw: run 'systemctl daemon-reload' and 'systemctl enable %s' to bring up containers at boot\n", SYSTEMD_TARGET)
+	return nil
+}